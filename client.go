@@ -9,6 +9,40 @@ import (
 	"google.golang.org/grpc/resolver"
 )
 
+// client balancer
+var (
+	clientBalancerName  = roundrobin.Name
+	clientBreakerConfig *balancer.CircuitBreakerConfig
+	clientOutlierConfig *balancer.OutlierDetectionConfig
+)
+
+// client balancer name : circuit breakers and / or outlier detection
+const clientCustomBalancerName = "bh_client_balancer"
+
+// EnableCircuitBreaker the clients pick with circuit breakers per address and per method
+func EnableCircuitBreaker(cfg *balancer.CircuitBreakerConfig) {
+	if cfg == nil {
+		cfg = &balancer.CircuitBreakerConfig{}
+	}
+	clientBreakerConfig = cfg
+	registerClientBalancer()
+}
+
+// EnableOutlierDetection the clients eject the outlier addresses
+func EnableOutlierDetection(cfg *balancer.OutlierDetectionConfig) {
+	if cfg == nil {
+		cfg = &balancer.OutlierDetectionConfig{}
+	}
+	clientOutlierConfig = cfg
+	registerClientBalancer()
+}
+
+// registerClientBalancer register the client balancer
+func registerClientBalancer() {
+	balancer.RegisterBalancer(clientCustomBalancerName, clientBreakerConfig, clientOutlierConfig)
+	clientBalancerName = clientCustomBalancerName
+}
+
 // NewClient grpc.Dail()
 func NewClient() *grpc.ClientConn {
 	// server config
@@ -43,7 +77,17 @@ func newClient(serverName string) *grpc.ClientConn {
 	}
 
 	// balancer name
-	opts = append(opts, grpc.WithBalancerName(roundrobin.Name))
+	opts = append(opts, grpc.WithBalancerName(clientBalancerName))
+
+	// interceptors : the request id is forwarded, the default deadline is set before the retries
+	unaryInterceptors := append([]grpc.UnaryClientInterceptor{NewRequestIDUnaryClientInterceptor()}, unaryClientInterceptors...)
+	if config.ClientDefaultTimeout > 0 || len(config.ClientMethodTimeouts) > 0 {
+		deadlineInterceptor := NewDeadlineUnaryClientInterceptor(config.ClientDefaultTimeout, config.ClientMethodTimeouts)
+		unaryInterceptors = append([]grpc.UnaryClientInterceptor{deadlineInterceptor}, unaryInterceptors...)
+	}
+	streamInterceptors := append([]grpc.StreamClientInterceptor{NewRequestIDStreamClientInterceptor()}, streamClientInterceptors...)
+	opts = append(opts, grpc.WithUnaryInterceptor(chainUnaryClientInterceptor(unaryInterceptors)))
+	opts = append(opts, grpc.WithStreamInterceptor(chainStreamClientInterceptor(streamInterceptors)))
 
 	// server address
 	serverAddr := r.Scheme() + "://ikaiguang/" + serverName
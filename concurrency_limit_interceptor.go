@@ -0,0 +1,342 @@
+package bhgrpcutils
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/buhuoxinxi/bh-go-grpc-utils/etcd_balancer"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// concurrency limit algorithm
+const (
+	ConcurrencyLimitGradient = "gradient" // limit follows the long rtt / short rtt gradient
+	ConcurrencyLimitAIMD     = "aimd"     // additive increase, multiplicative decrease on slow calls
+)
+
+// call priority metadata
+const (
+	PriorityMetadataKey = "x-request-priority" // metadata key
+	PriorityCritical    = "critical"           // shed last, up to limit * CriticalRatio
+	PrioritySheddable   = "sheddable"          // shed first, up to limit * SheddableRatio
+)
+
+// concurrency limit config
+const (
+	defaultConcurrencyInitialLimit    = 20
+	defaultConcurrencyMinLimit        = 5
+	defaultConcurrencyMaxLimit        = 1000
+	defaultConcurrencySampleWindow    = time.Second
+	defaultConcurrencySmoothing       = 0.2
+	defaultConcurrencyTolerance       = 1.5
+	defaultConcurrencyBackoffRatio    = 0.9
+	defaultConcurrencyLatencyLimit    = time.Second
+	defaultConcurrencyCriticalRatio   = 1.5
+	defaultConcurrencySheddableRatio  = 0.8
+	defaultConcurrencyOverloadRatio   = 0.1
+	defaultConcurrencyRecoverDelay    = 10 * time.Second
+	concurrencyLongRTTDecay           = 0.95 // long rtt ema : long * decay + sample * (1 - decay)
+	concurrencyMinGradient            = 0.5
+	concurrencyOverloadMinCallsPerSec = 1
+)
+
+// ConcurrencyLimitConfig adaptive concurrency limit interceptor config
+type ConcurrencyLimitConfig struct {
+	Algorithm      string        // ConcurrencyLimitGradient(default) or ConcurrencyLimitAIMD
+	InitialLimit   int           // initial in flight limit
+	MinLimit       int           // min in flight limit
+	MaxLimit       int           // max in flight limit
+	SampleWindow   time.Duration // the limit is adjusted once per window
+	Smoothing      float64       // gradient : new limit weight
+	Tolerance      float64       // gradient : short rtt tolerated up to long rtt * tolerance
+	BackoffRatio   float64       // aimd : limit * ratio on slow calls
+	LatencyLimit   time.Duration // aimd : mean rtt above the limit is slow
+	CriticalRatio  float64       // critical calls are shed above limit * ratio
+	SheddableRatio float64       // sheddable calls are shed above limit * ratio
+
+	MarkUnhealthy bool                  // remove the server key from etcd while overloaded, not with LeaderOnly
+	OverloadRatio float64               // overloaded when shed calls / calls of the window >= ratio
+	RecoverDelay  time.Duration         // serving again after the delay without shedding
+	OnOverload    func(overloaded bool) // overload hook
+}
+
+// init default config
+func (cfg *ConcurrencyLimitConfig) init() {
+	if cfg.Algorithm == "" {
+		cfg.Algorithm = ConcurrencyLimitGradient
+	}
+	if cfg.MinLimit <= 0 {
+		cfg.MinLimit = defaultConcurrencyMinLimit
+	}
+	if cfg.MaxLimit <= 0 {
+		cfg.MaxLimit = defaultConcurrencyMaxLimit
+	}
+	if cfg.InitialLimit <= 0 {
+		cfg.InitialLimit = defaultConcurrencyInitialLimit
+	}
+	if cfg.SampleWindow <= 0 {
+		cfg.SampleWindow = defaultConcurrencySampleWindow
+	}
+	if cfg.Smoothing <= 0 || cfg.Smoothing > 1 {
+		cfg.Smoothing = defaultConcurrencySmoothing
+	}
+	if cfg.Tolerance < 1 {
+		cfg.Tolerance = defaultConcurrencyTolerance
+	}
+	if cfg.BackoffRatio <= 0 || cfg.BackoffRatio >= 1 {
+		cfg.BackoffRatio = defaultConcurrencyBackoffRatio
+	}
+	if cfg.LatencyLimit <= 0 {
+		cfg.LatencyLimit = defaultConcurrencyLatencyLimit
+	}
+	if cfg.CriticalRatio < 1 {
+		cfg.CriticalRatio = defaultConcurrencyCriticalRatio
+	}
+	if cfg.SheddableRatio <= 0 || cfg.SheddableRatio > 1 {
+		cfg.SheddableRatio = defaultConcurrencySheddableRatio
+	}
+	if cfg.OverloadRatio <= 0 {
+		cfg.OverloadRatio = defaultConcurrencyOverloadRatio
+	}
+	if cfg.RecoverDelay <= 0 {
+		cfg.RecoverDelay = defaultConcurrencyRecoverDelay
+	}
+}
+
+// NewConcurrencyLimitUnaryInterceptor adaptive in flight limit, the excess calls
+// are shed with codes.Unavailable
+//
+// the limit is adjusted from the observed latency per sample window. the
+// PriorityMetadataKey metadata lets the critical calls pass over the limit.
+func NewConcurrencyLimitUnaryInterceptor(cfg *ConcurrencyLimitConfig) grpc.UnaryServerInterceptor {
+	cfg.init()
+	limiter := &concurrencyLimiter{
+		config:     cfg,
+		limit:      float64(cfg.InitialLimit),
+		windowTime: time.Now(),
+		serving:    true,
+	}
+
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		startTime, ok := limiter.acquire(callPriority(ctx))
+		if !ok {
+			return nil, status.Errorf(codes.Unavailable, "server overloaded, concurrency limit exceeded : %s", info.FullMethod)
+		}
+		defer func() {
+			limiter.release(startTime, err)
+		}()
+		return handler(ctx, req)
+	}
+}
+
+// callPriority priority metadata
+func callPriority(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if values := md.Get(PriorityMetadataKey); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// concurrencyLimiter adaptive in flight limit
+type concurrencyLimiter struct {
+	config *ConcurrencyLimitConfig
+
+	mutex       sync.Mutex
+	limit       float64
+	inFlight    int
+	longRTT     time.Duration // ema of the sample rtt
+	windowTime  time.Time
+	rttSum      time.Duration // window rtt
+	rttCount    int           // window completed calls
+	maxInFlight int           // window max in flight
+	dropped     bool          // window has timeout calls
+	calls       int           // window calls
+	shed        int           // window shed calls
+	overloaded  bool
+	lastShed    time.Time
+
+	servingMutex sync.Mutex // serialize the etcd serving updates
+	serving      bool       // etcd serving state applied
+}
+
+// acquire in flight slot
+func (l *concurrencyLimiter) acquire(priority string) (time.Time, bool) {
+	now := time.Now()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	limit := l.limit
+	switch priority {
+	case PriorityCritical:
+		limit *= l.config.CriticalRatio
+	case PrioritySheddable:
+		limit *= l.config.SheddableRatio
+	}
+
+	l.calls++
+	if float64(l.inFlight) >= math.Max(1, limit) {
+		l.shed++
+		l.lastShed = now
+		return now, false
+	}
+	l.inFlight++
+	if l.inFlight > l.maxInFlight {
+		l.maxInFlight = l.inFlight
+	}
+	return now, true
+}
+
+// release in flight slot, adjust the limit once per window
+func (l *concurrencyLimiter) release(startTime time.Time, err error) {
+	now := time.Now()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.inFlight--
+	l.rttSum += now.Sub(startTime)
+	l.rttCount++
+	if code := status.Code(err); code == codes.DeadlineExceeded || code == codes.Canceled {
+		l.dropped = true
+	}
+
+	if now.Sub(l.windowTime) < l.config.SampleWindow {
+		return
+	}
+	l.adjust(now)
+}
+
+// adjust limit & overload state, reset the window
+func (l *concurrencyLimiter) adjust(now time.Time) {
+	sampleRTT := l.rttSum / time.Duration(l.rttCount)
+	oldLimit := l.limit
+
+	switch l.config.Algorithm {
+	case ConcurrencyLimitAIMD:
+		if l.dropped || sampleRTT > l.config.LatencyLimit {
+			l.limit *= l.config.BackoffRatio
+		} else if float64(l.maxInFlight) >= l.limit/2 {
+			l.limit++
+		}
+
+	default:
+		// long rtt
+		if l.longRTT == 0 {
+			l.longRTT = sampleRTT
+		} else {
+			l.longRTT = time.Duration(float64(l.longRTT)*concurrencyLongRTTDecay + float64(sampleRTT)*(1-concurrencyLongRTTDecay))
+		}
+		// recovering : the long rtt is drained faster
+		if l.longRTT > 2*sampleRTT {
+			l.longRTT = time.Duration(float64(l.longRTT) * concurrencyLongRTTDecay)
+		}
+		// app limited : not increased
+		if float64(l.maxInFlight) >= l.limit/2 || sampleRTT > l.longRTT {
+			gradient := math.Max(concurrencyMinGradient, math.Min(1, l.config.Tolerance*float64(l.longRTT)/float64(sampleRTT)))
+			newLimit := l.limit*gradient + math.Sqrt(l.limit)
+			l.limit = l.limit*(1-l.config.Smoothing) + newLimit*l.config.Smoothing
+		}
+	}
+	l.limit = math.Max(float64(l.config.MinLimit), math.Min(float64(l.config.MaxLimit), l.limit))
+	if int(oldLimit) != int(l.limit) {
+		logrus.Debugf("concurrency limit : %d => %d, rtt %v, long rtt %v", int(oldLimit), int(l.limit), sampleRTT, l.longRTT)
+	}
+
+	// overload
+	windowSeconds := now.Sub(l.windowTime).Seconds()
+	if l.calls >= int(concurrencyOverloadMinCallsPerSec*windowSeconds) && float64(l.shed) >= l.config.OverloadRatio*float64(l.calls) {
+		l.setOverloaded(true)
+	}
+
+	l.windowTime = now
+	l.rttSum, l.rttCount = 0, 0
+	l.maxInFlight, l.dropped = l.inFlight, false
+	l.calls, l.shed = 0, 0
+}
+
+// setOverloaded change the overload state, the hooks run in background
+func (l *concurrencyLimiter) setOverloaded(overloaded bool) {
+	if l.overloaded == overloaded {
+		return
+	}
+	l.overloaded = overloaded
+	logrus.Warnf("[warn] concurrency limit overloaded : %v, limit %d", overloaded, int(l.limit))
+
+	if l.config.OnOverload != nil {
+		go l.config.OnOverload(overloaded)
+	}
+	// the leader server has no registrar
+	if l.config.MarkUnhealthy && !config.LeaderOnly {
+		go l.applyServing()
+	}
+
+	// the calls stop while not serving : recover by time
+	if overloaded {
+		go l.waitRecover()
+	}
+}
+
+// waitRecover not overloaded after the recover delay without shedding
+func (l *concurrencyLimiter) waitRecover() {
+	ticker := time.NewTicker(l.config.RecoverDelay / 2)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		l.mutex.Lock()
+		if !l.overloaded {
+			l.mutex.Unlock()
+			return
+		}
+		if now.Sub(l.lastShed) >= l.config.RecoverDelay {
+			l.setOverloaded(false)
+			l.mutex.Unlock()
+			return
+		}
+		l.mutex.Unlock()
+	}
+}
+
+// applyServing apply the current overload state to etcd, one update at a
+// time : the state is read again under the serving lock, a stale update is
+// not applied after a newer one
+func (l *concurrencyLimiter) applyServing() {
+	l.servingMutex.Lock()
+	defer l.servingMutex.Unlock()
+
+	l.mutex.Lock()
+	serving := !l.overloaded
+	l.mutex.Unlock()
+
+	if serving != l.serving && setServerServing(serving) {
+		l.serving = serving
+	}
+}
+
+// setServerServing mark the server key in etcd, the last serving instance is kept
+func setServerServing(serving bool) bool {
+	serverAddr := net.JoinHostPort(config.ServerHost, config.ServerPort)
+	if !serving {
+		ctx, cancelFn := context.WithTimeout(context.Background(), defaultConcurrencyRecoverDelay)
+		count, err := balancer.CountRegisteredServers(ctx)
+		cancelFn()
+		if err != nil || count <= 1 {
+			return false
+		}
+	}
+	if err := balancer.SetServerServing(serverAddr, serving); err != nil {
+		logrus.Errorf("[E] balancer.SetServerServing error : %v", err)
+		return false
+	}
+	return true
+}
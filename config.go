@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // server config
@@ -14,6 +15,12 @@ const (
 	defaultServerPort = "50051" // default port
 )
 
+// server environment
+const (
+	EnvironmentProduction  = "production"  // the internal error text is hidden (default)
+	EnvironmentDevelopment = "development" // the internal error text is sent
+)
+
 // server env
 const (
 	envKeyServerHost          = "BhServerHost"          // server host
@@ -23,6 +30,15 @@ const (
 	envKeyServerSSLCertFile   = "BhServerSSLCertFile"   // ssl cert
 	envKeyServerSSLKeyFile    = "BhServerSSLKeyFile"    // ssl key
 	envKeyServerSSLServerName = "BhServerSSLServerName" // ssl server name
+	envKeyServerLeaderOnly    = "BhServerLeaderOnly"    // leader only
+	envKeyServerEnvironment   = "BhServerEnvironment"   // production or development
+)
+
+// client env
+const (
+	envKeyClientDefaultTimeout = "BhClientDefaultTimeout" // default deadline, e.g. 10s
+	envKeyClientMethodTimeouts = "BhClientMethodTimeouts" // method deadlines, e.g. /pkg.Service/Method=3s,/pkg.Service/Other=500ms
+	envSepClientMethodTimeouts = ","                      // method deadlines separators
 )
 
 // Config server config
@@ -34,6 +50,16 @@ type Config struct {
 	SSLCertFile   string // ssl cert file path
 	SSLKeyFile    string // ssl key file path
 	SSLServerName string // ssl name
+	LeaderOnly    bool   // register server only while holding the leadership
+	Environment   string // EnvironmentProduction or EnvironmentDevelopment
+
+	ClientDefaultTimeout time.Duration            // client default deadline, without the deadline if 0
+	ClientMethodTimeouts map[string]time.Duration // client deadline per full method
+}
+
+// IsProduction production environment
+func (cfg *Config) IsProduction() bool {
+	return cfg.Environment != EnvironmentDevelopment
 }
 
 // SetConfig set config
@@ -66,10 +92,55 @@ var DefaultConfigFn = func() {
 		parseServerSSLEnv(&cfg)
 	}
 
+	// leader only
+	cfg.LeaderOnly, _ = strconv.ParseBool(strings.TrimSpace(os.Getenv(envKeyServerLeaderOnly)))
+
+	// environment
+	if env := strings.TrimSpace(os.Getenv(envKeyServerEnvironment)); len(env) > 0 {
+		cfg.Environment = env
+	} else {
+		cfg.Environment = EnvironmentProduction
+	}
+
+	// client deadlines
+	parseClientTimeoutEnv(&cfg)
+
 	// init
 	SetConfig(&cfg)
 }
 
+// parseClientTimeoutEnv parse client deadline env
+func parseClientTimeoutEnv(cfg *Config) {
+	// default
+	if timeout := strings.TrimSpace(os.Getenv(envKeyClientDefaultTimeout)); len(timeout) > 0 {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			logrus.Errorf("%s time.ParseDuration error : %v", envKeyClientDefaultTimeout, err)
+		}
+		cfg.ClientDefaultTimeout = d
+	}
+
+	// method
+	timeouts := strings.TrimSpace(os.Getenv(envKeyClientMethodTimeouts))
+	if len(timeouts) == 0 {
+		return
+	}
+	cfg.ClientMethodTimeouts = make(map[string]time.Duration)
+	for _, item := range strings.Split(timeouts, envSepClientMethodTimeouts) {
+		kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(kv) != 2 {
+			logrus.Errorf("%s invalid item : %s", envKeyClientMethodTimeouts, item)
+			continue
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(kv[1]))
+		if err != nil {
+			logrus.Errorf("%s time.ParseDuration error : %v", envKeyClientMethodTimeouts, err)
+			continue
+		}
+		cfg.ClientMethodTimeouts[strings.TrimSpace(kv[0])] = d
+	}
+}
+
 // parseServerSSLEnv parse server ssl env
 func parseServerSSLEnv(cfg *Config) {
 	// pwd
@@ -0,0 +1,129 @@
+package bhgrpcutils
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// NewDeadlineUnaryClientInterceptor set the method deadline, or the default
+// deadline, when the ctx has no deadline
+func NewDeadlineUnaryClientInterceptor(defaultTimeout time.Duration, methodTimeouts map[string]time.Duration) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if _, ok := ctx.Deadline(); ok {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		timeout, ok := methodTimeouts[method]
+		if !ok {
+			timeout = defaultTimeout
+		}
+		if timeout <= 0 {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		ctx, cancelFn := context.WithTimeout(ctx, timeout)
+		defer cancelFn()
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// DeadlineConfig server deadline interceptor config
+type DeadlineConfig struct {
+	MaxDeadline time.Duration // the caller deadline is capped, and set if missing
+	MinBudget   time.Duration // reject the call with less remaining time
+}
+
+// NewDeadlineUnaryServerInterceptor cap the deadline, reject the call without
+// enough remaining budget, and log the deadline exceeded calls
+func NewDeadlineUnaryServerInterceptor(cfg *DeadlineConfig) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		ctx, budget, cancelFn, err := applyServerDeadline(ctx, cfg, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		defer cancelFn()
+
+		startTime := time.Now()
+		resp, err = handler(ctx, req)
+		logDeadlineExceeded(ctx, info.FullMethod, budget, startTime, err)
+		return resp, err
+	}
+}
+
+// NewDeadlineStreamServerInterceptor cap the stream deadline, reject the stream
+// without enough remaining budget, and log the deadline exceeded streams
+func NewDeadlineStreamServerInterceptor(cfg *DeadlineConfig) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, budget, cancelFn, err := applyServerDeadline(ss.Context(), cfg, info.FullMethod)
+		if err != nil {
+			return err
+		}
+		defer cancelFn()
+
+		startTime := time.Now()
+		err = handler(srv, &contextServerStream{ServerStream: ss, ctx: ctx})
+		logDeadlineExceeded(ctx, info.FullMethod, budget, startTime, err)
+		return err
+	}
+}
+
+// applyServerDeadline capped ctx & the remaining budget, 0 if no deadline
+func applyServerDeadline(ctx context.Context, cfg *DeadlineConfig, method string) (context.Context, time.Duration, context.CancelFunc, error) {
+	deadline, hasDeadline := ctx.Deadline()
+	var budget time.Duration
+	if hasDeadline {
+		budget = time.Until(deadline)
+	}
+
+	// expired
+	if hasDeadline && budget <= 0 {
+		Logger(ctx).WithField("method", method).Warn("deadline exceeded before the call, call rejected")
+		return ctx, 0, nil, status.Errorf(codes.DeadlineExceeded, "deadline exceeded before the call : %s", method)
+	}
+
+	// remaining budget
+	if hasDeadline && budget < cfg.MinBudget {
+		Logger(ctx).WithFields(logrus.Fields{
+			"method":     method,
+			"budget":     budget.String(),
+			"min_budget": cfg.MinBudget.String(),
+		}).Warn("deadline budget too small, call rejected")
+		return ctx, budget, nil, status.Errorf(codes.DeadlineExceeded, "deadline budget %v is less than %v : %s", budget, cfg.MinBudget, method)
+	}
+
+	// max deadline
+	if cfg.MaxDeadline > 0 && (!hasDeadline || budget > cfg.MaxDeadline) {
+		ctx, cancelFn := context.WithTimeout(ctx, cfg.MaxDeadline)
+		return ctx, cfg.MaxDeadline, cancelFn, nil
+	}
+	return ctx, budget, func() {}, nil
+}
+
+// logDeadlineExceeded log the deadline exceeded call with timing
+func logDeadlineExceeded(ctx context.Context, method string, budget time.Duration, startTime time.Time, err error) {
+	if status.Code(err) != codes.DeadlineExceeded && ctx.Err() != context.DeadlineExceeded {
+		return
+	}
+	fields := logrus.Fields{
+		"method":  method,
+		"elapsed": time.Since(startTime).String(),
+	}
+	if budget > 0 {
+		fields["budget"] = budget.String()
+	}
+	Logger(ctx).WithFields(fields).Warn("deadline exceeded")
+}
+
+// contextServerStream server stream with the wrapped ctx
+type contextServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context wrapped ctx
+func (s *contextServerStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,155 @@
+package bhgrpcutils
+
+import (
+	"database/sql"
+	"errors"
+	"reflect"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// error mapping config
+const (
+	defaultErrorMappingMessage = "internal error" // production message of the unmapped errors
+)
+
+// ErrorMapping handler error => grpc code
+type ErrorMapping struct {
+	Target  error            // matched by errors.Is
+	Match   func(error) bool // or matched by the func, e.g. ErrorAs
+	Code    codes.Code       // grpc code
+	Message string           // client message, the error text in development if empty
+}
+
+// matches error matched
+func (m *ErrorMapping) matches(err error) bool {
+	if m.Match != nil {
+		return m.Match(err)
+	}
+	return m.Target != nil && errors.Is(err, m.Target)
+}
+
+// ErrorAs match the error type by errors.As, target is a pointer to the error
+// type like errors.As : ErrorAs(new(*ValidationError))
+func ErrorAs(target interface{}) func(error) bool {
+	targetType := reflect.TypeOf(target)
+	if targetType == nil || targetType.Kind() != reflect.Ptr {
+		panic("bhgrpcutils: ErrorAs target must be a non-nil pointer")
+	}
+	return func(err error) bool {
+		return errors.As(err, reflect.New(targetType.Elem()).Interface())
+	}
+}
+
+// DefaultErrorMappings the mappings after the config mappings
+var DefaultErrorMappings = []*ErrorMapping{
+	{Target: context.DeadlineExceeded, Code: codes.DeadlineExceeded},
+	{Target: context.Canceled, Code: codes.Canceled},
+	{Target: sql.ErrNoRows, Code: codes.NotFound, Message: "not found"},
+}
+
+// ErrorMappingConfig error mapping interceptor config
+type ErrorMappingConfig struct {
+	Mappings    []*ErrorMapping // matched in order, before DefaultErrorMappings
+	DefaultCode codes.Code      // code of the unmapped errors, codes.Internal if OK
+}
+
+// NewErrorMappingUnaryInterceptor map the handler errors to the grpc status
+//
+// *Error and status errors are sent as is, the other errors are mapped by the
+// table; the internal error text is hidden in production and logged with the
+// caller location.
+func NewErrorMappingUnaryInterceptor(cfg *ErrorMappingConfig) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		resp, err = handler(ctx, req)
+		if err != nil {
+			err = mapError(ctx, cfg, info.FullMethod, err)
+		}
+		return resp, err
+	}
+}
+
+// NewErrorMappingStreamInterceptor map the stream handler errors to the grpc status
+func NewErrorMappingStreamInterceptor(cfg *ErrorMappingConfig) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := handler(srv, ss); err != nil {
+			return mapError(ss.Context(), cfg, info.FullMethod, err)
+		}
+		return nil
+	}
+}
+
+// mapError grpc status error of the handler error
+func mapError(ctx context.Context, cfg *ErrorMappingConfig, method string, err error) error {
+	fields := logrus.Fields{
+		"method": method,
+		"error":  err.Error(),
+	}
+
+	// application error : the message is for the client
+	var appErr *Error
+	if errors.As(err, &appErr) {
+		if file, line := appErr.Caller(); file != "" {
+			fields["file"], fields["line"] = file, line
+		}
+		logMappedError(ctx, fields, appErr.Code)
+		return appErr.GRPCStatus().Err()
+	}
+
+	// status error
+	var statusErr interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &statusErr) {
+		s := statusErr.GRPCStatus()
+		logMappedError(ctx, fields, s.Code())
+		return s.Err()
+	}
+
+	// mapping table
+	code, message := cfg.DefaultCode, ""
+	if code == codes.OK {
+		code = codes.Internal
+	}
+	for _, mappings := range [][]*ErrorMapping{cfg.Mappings, DefaultErrorMappings} {
+		if m := findErrorMapping(mappings, err); m != nil {
+			code, message = m.Code, m.Message
+			break
+		}
+	}
+	if message == "" {
+		if config.IsProduction() {
+			message = defaultErrorMappingMessage
+			if code != codes.Internal && code != codes.Unknown {
+				message = code.String()
+			}
+		} else {
+			message = err.Error()
+		}
+	}
+	logMappedError(ctx, fields, code)
+	return status.Error(code, message)
+}
+
+// findErrorMapping first matched mapping
+func findErrorMapping(mappings []*ErrorMapping, err error) *ErrorMapping {
+	for _, m := range mappings {
+		if m.matches(err) {
+			return m
+		}
+	}
+	return nil
+}
+
+// logMappedError server errors are logged as error, client errors as info
+func logMappedError(ctx context.Context, fields logrus.Fields, code codes.Code) {
+	fields["code"] = code.String()
+	switch code {
+	case codes.Internal, codes.Unknown, codes.DataLoss, codes.Unimplemented:
+		Logger(ctx).WithFields(fields).Error("request error")
+	default:
+		Logger(ctx).WithFields(fields).Info("request error")
+	}
+}
@@ -0,0 +1,251 @@
+package bhgrpcutils
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultErrorDomain ErrorInfo domain of the registered error codes
+var DefaultErrorDomain = "bhgrpcutils"
+
+// error code registry : domain + reason => *Error
+var errorCodeRegistry sync.Map
+
+// RegisterErrorCode register application error code, the returned error is
+// the sentinel of errors.Is
+//
+//	var ErrOrderNotFound = bhgrpcutils.RegisterErrorCode("ORDER_NOT_FOUND", codes.NotFound, "order not found")
+func RegisterErrorCode(reason string, code codes.Code, message string) *Error {
+	return RegisterDomainErrorCode(DefaultErrorDomain, reason, code, message)
+}
+
+// RegisterDomainErrorCode register application error code of the domain
+func RegisterDomainErrorCode(domain, reason string, code codes.Code, message string) *Error {
+	e := &Error{Code: code, Reason: reason, Domain: domain, Message: message}
+	if _, loaded := errorCodeRegistry.LoadOrStore(domain+"/"+reason, e); loaded {
+		panic("bhgrpcutils: error code registered twice : " + domain + "/" + reason)
+	}
+	return e
+}
+
+// lookupErrorCode registered error code
+func lookupErrorCode(domain, reason string) (*Error, bool) {
+	if e, ok := errorCodeRegistry.Load(domain + "/" + reason); ok {
+		return e.(*Error), true
+	}
+	return nil, false
+}
+
+// Error application error : grpc code, ErrorInfo reason & domain and the status details
+//
+// the error is converted to the grpc status by the server, FromError converts
+// the status back on the client.
+type Error struct {
+	Code     codes.Code        // grpc code
+	Reason   string            // ErrorInfo reason, e.g. ORDER_NOT_FOUND
+	Domain   string            // ErrorInfo domain
+	Message  string            // status message
+	Metadata map[string]string // ErrorInfo metadata
+
+	FieldViolations  []*errdetails.BadRequest_FieldViolation // BadRequest details
+	RetryDelay       time.Duration                           // RetryInfo details, none if 0
+	LocalizedMessage *errdetails.LocalizedMessage            // LocalizedMessage details
+	Details          []proto.Message                         // other details
+
+	cause error
+	file  string // caller of Wrap / NewError
+	line  int
+}
+
+// Error message
+func (e *Error) Error() string {
+	if e.cause != nil {
+		return e.Message + " : " + e.cause.Error()
+	}
+	return e.Message
+}
+
+// Unwrap wrapped error
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
+// Is same code, reason & domain; use status.Code to match the code only
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+	return t.Code == e.Code && t.Reason == e.Reason && t.Domain == e.Domain
+}
+
+// clone copy, the registered error is not changed
+func (e *Error) clone() *Error {
+	c := *e
+	if e.Metadata != nil {
+		c.Metadata = make(map[string]string, len(e.Metadata))
+		for k, v := range e.Metadata {
+			c.Metadata[k] = v
+		}
+	}
+	c.FieldViolations = append([]*errdetails.BadRequest_FieldViolation(nil), e.FieldViolations...)
+	c.Details = append([]proto.Message(nil), e.Details...)
+	return &c
+}
+
+// Wrap wrap the cause, the cause text is not sent to the client
+func (e *Error) Wrap(cause error) *Error {
+	c := e.clone()
+	c.cause = cause
+	_, c.file, c.line, _ = runtime.Caller(1)
+	return c
+}
+
+// Caller file & line of Wrap / NewError, empty file if unknown
+func (e *Error) Caller() (file string, line int) {
+	return e.file, e.line
+}
+
+// WithMessage replace the message
+func (e *Error) WithMessage(format string, args ...interface{}) *Error {
+	c := e.clone()
+	c.Message = fmt.Sprintf(format, args...)
+	return c
+}
+
+// WithMetadata add ErrorInfo metadata
+func (e *Error) WithMetadata(key, value string) *Error {
+	c := e.clone()
+	if c.Metadata == nil {
+		c.Metadata = make(map[string]string)
+	}
+	c.Metadata[key] = value
+	return c
+}
+
+// WithFieldViolation add BadRequest field violation
+func (e *Error) WithFieldViolation(field, description string) *Error {
+	c := e.clone()
+	c.FieldViolations = append(c.FieldViolations, &errdetails.BadRequest_FieldViolation{Field: field, Description: description})
+	return c
+}
+
+// WithRetryDelay set RetryInfo
+func (e *Error) WithRetryDelay(delay time.Duration) *Error {
+	c := e.clone()
+	c.RetryDelay = delay
+	return c
+}
+
+// WithLocalizedMessage set LocalizedMessage, locale e.g. zh-CN
+func (e *Error) WithLocalizedMessage(locale, message string) *Error {
+	c := e.clone()
+	c.LocalizedMessage = &errdetails.LocalizedMessage{Locale: locale, Message: message}
+	return c
+}
+
+// WithDetails add other details
+func (e *Error) WithDetails(details ...proto.Message) *Error {
+	c := e.clone()
+	c.Details = append(c.Details, details...)
+	return c
+}
+
+// GRPCStatus status with the details, used by grpc
+func (e *Error) GRPCStatus() *status.Status {
+	s := status.New(e.Code, e.Message)
+
+	var details []proto.Message
+	if e.Reason != "" {
+		details = append(details, &errdetails.ErrorInfo{Reason: e.Reason, Domain: e.Domain, Metadata: e.Metadata})
+	}
+	if len(e.FieldViolations) > 0 {
+		details = append(details, &errdetails.BadRequest{FieldViolations: e.FieldViolations})
+	}
+	if e.RetryDelay > 0 {
+		details = append(details, &errdetails.RetryInfo{RetryDelay: ptypes.DurationProto(e.RetryDelay)})
+	}
+	if e.LocalizedMessage != nil {
+		details = append(details, e.LocalizedMessage)
+	}
+	details = append(details, e.Details...)
+	if len(details) == 0 {
+		return s
+	}
+
+	ds, err := s.WithDetails(details...)
+	if err != nil {
+		return s
+	}
+	return ds
+}
+
+// ToStatus status of the error, the wrapped *Error and grpc status are found by errors.As
+func ToStatus(err error) *status.Status {
+	if err == nil {
+		return status.New(codes.OK, "")
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.GRPCStatus()
+	}
+	var se interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &se) {
+		return se.GRPCStatus()
+	}
+	return status.New(codes.Unknown, err.Error())
+}
+
+// FromError client side : the typed *Error of the rpc error
+//
+// the registered error code is found by the ErrorInfo reason & domain, so
+// errors.Is(err, ErrOrderNotFound) works on the client. nil if err is nil.
+func FromError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return FromStatus(status.Convert(err))
+}
+
+// FromStatus client side : the typed *Error of the status
+func FromStatus(s *status.Status) *Error {
+	if s == nil || s.Code() == codes.OK {
+		return nil
+	}
+	e := &Error{Code: s.Code(), Message: s.Message()}
+	for _, detail := range s.Details() {
+		switch d := detail.(type) {
+		case *errdetails.ErrorInfo:
+			e.Reason, e.Domain, e.Metadata = d.Reason, d.Domain, d.Metadata
+		case *errdetails.BadRequest:
+			e.FieldViolations = append(e.FieldViolations, d.FieldViolations...)
+		case *errdetails.RetryInfo:
+			if delay, err := ptypes.Duration(d.RetryDelay); err == nil {
+				e.RetryDelay = delay
+			}
+		case *errdetails.LocalizedMessage:
+			e.LocalizedMessage = d
+		case proto.Message:
+			e.Details = append(e.Details, d)
+		}
+	}
+
+	// registered error code : the sentinel message
+	if registered, ok := lookupErrorCode(e.Domain, e.Reason); ok && e.Message == "" {
+		e.Message = registered.Message
+	}
+	return e
+}
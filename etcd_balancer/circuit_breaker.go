@@ -0,0 +1,247 @@
+package balancer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// CircuitBreakerBalancerName balancer name
+const CircuitBreakerBalancerName = "bh_circuit_breaker"
+
+// circuit breaker config
+const (
+	defaultCircuitBreakerFailureRate      = 0.5              // failure rate threshold
+	defaultCircuitBreakerSlowCallRate     = 0.8              // slow call rate threshold
+	defaultCircuitBreakerSlowCallDuration = 3 * time.Second  // slow call duration
+	defaultCircuitBreakerMinRequests      = 20               // minimum calls per window
+	defaultCircuitBreakerWindow           = 10 * time.Second // statistics window
+	defaultCircuitBreakerOpenTimeout      = 5 * time.Second  // open => half open
+	defaultCircuitBreakerHalfOpenRequests = 3                // half open probe calls
+)
+
+// CircuitBreakerState circuit breaker state
+type CircuitBreakerState int32
+
+// circuit breaker state
+const (
+	CircuitBreakerClosed   CircuitBreakerState = iota // closed : pass
+	CircuitBreakerOpen                                // open : ejected
+	CircuitBreakerHalfOpen                            // half open : probe calls
+)
+
+// String state name
+func (s CircuitBreakerState) String() string {
+	switch s {
+	case CircuitBreakerClosed:
+		return "closed"
+	case CircuitBreakerOpen:
+		return "open"
+	case CircuitBreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitBreakerConfig circuit breaker config
+type CircuitBreakerConfig struct {
+	FailureRate      float64       // open when failures / calls >= rate
+	SlowCallRate     float64       // open when slow calls / calls >= rate
+	SlowCallDuration time.Duration // call slower than the duration is a slow call
+	MinRequests      int           // minimum calls per window before the rates count
+	Window           time.Duration // statistics window
+	OpenTimeout      time.Duration // open duration before half open
+	HalfOpenRequests int           // half open probe calls, all success => closed
+	FailureCodes     []codes.Code  // failure codes, default Unavailable, DeadlineExceeded, Internal, Unknown
+}
+
+// init default config
+func (cfg *CircuitBreakerConfig) init() {
+	if cfg.FailureRate <= 0 {
+		cfg.FailureRate = defaultCircuitBreakerFailureRate
+	}
+	if cfg.SlowCallRate <= 0 {
+		cfg.SlowCallRate = defaultCircuitBreakerSlowCallRate
+	}
+	if cfg.SlowCallDuration <= 0 {
+		cfg.SlowCallDuration = defaultCircuitBreakerSlowCallDuration
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = defaultCircuitBreakerMinRequests
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = defaultCircuitBreakerWindow
+	}
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = defaultCircuitBreakerOpenTimeout
+	}
+	if cfg.HalfOpenRequests <= 0 {
+		cfg.HalfOpenRequests = defaultCircuitBreakerHalfOpenRequests
+	}
+	if len(cfg.FailureCodes) == 0 {
+		cfg.FailureCodes = []codes.Code{codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown}
+	}
+}
+
+// isFailure failure code
+func (cfg *CircuitBreakerConfig) isFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	code := status.Code(err)
+	for _, c := range cfg.FailureCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// RegisterCircuitBreakerBalancer register the round robin balancer with
+// circuit breakers per address and per method
+func RegisterCircuitBreakerBalancer(cfg *CircuitBreakerConfig) {
+	if cfg == nil {
+		cfg = &CircuitBreakerConfig{}
+	}
+	RegisterBalancer(CircuitBreakerBalancerName, cfg, nil)
+}
+
+// circuitBreaker address & method circuit breaker
+type circuitBreaker struct {
+	config *CircuitBreakerConfig
+	addr   string
+	method string
+
+	mutex        sync.Mutex
+	state        CircuitBreakerState
+	windowTime   time.Time // window start
+	calls        int       // calls in window
+	failures     int       // failures in window
+	slowCalls    int       // slow calls in window
+	openTime     time.Time // open since
+	reason       string    // open reason
+	probeCalls   int       // half open calls in flight or done
+	probeSuccess int       // half open success calls
+}
+
+// allow call, or the open reason & retry delay
+func (b *circuitBreaker) allow(now time.Time) (ok bool, reason string, retryDelay time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case CircuitBreakerOpen:
+		if wait := b.openTime.Add(b.config.OpenTimeout).Sub(now); wait > 0 {
+			return false, b.reason, wait
+		}
+		b.setState(CircuitBreakerHalfOpen, b.reason)
+		b.probeCalls, b.probeSuccess = 0, 0
+		fallthrough
+
+	case CircuitBreakerHalfOpen:
+		if b.probeCalls >= b.config.HalfOpenRequests {
+			return false, b.reason, b.config.OpenTimeout
+		}
+		b.probeCalls++
+	}
+	return true, "", 0
+}
+
+// done record the call result
+func (b *circuitBreaker) done(now time.Time, duration time.Duration, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	isFailure := b.config.isFailure(err)
+	isSlow := duration >= b.config.SlowCallDuration
+
+	switch b.state {
+	case CircuitBreakerHalfOpen:
+		if isFailure {
+			b.open(now, fmt.Sprintf("half-open probe failed : %v", status.Code(err)))
+			return
+		}
+		if isSlow {
+			b.open(now, fmt.Sprintf("half-open probe slow call : %v", duration))
+			return
+		}
+		b.probeSuccess++
+		if b.probeSuccess >= b.config.HalfOpenRequests {
+			b.setState(CircuitBreakerClosed, "")
+			b.resetWindow(now)
+		}
+		return
+
+	case CircuitBreakerOpen:
+		// call picked before open
+		return
+	}
+
+	// closed
+	if now.Sub(b.windowTime) >= b.config.Window {
+		b.resetWindow(now)
+	}
+	b.calls++
+	if isFailure {
+		b.failures++
+	}
+	if isSlow {
+		b.slowCalls++
+	}
+	if b.calls < b.config.MinRequests {
+		return
+	}
+	if rate := float64(b.failures) / float64(b.calls); rate >= b.config.FailureRate {
+		b.open(now, fmt.Sprintf("failure rate %.2f >= %.2f", rate, b.config.FailureRate))
+	} else if rate := float64(b.slowCalls) / float64(b.calls); rate >= b.config.SlowCallRate {
+		b.open(now, fmt.Sprintf("slow call rate %.2f >= %.2f", rate, b.config.SlowCallRate))
+	}
+}
+
+// open circuit breaker
+func (b *circuitBreaker) open(now time.Time, reason string) {
+	b.openTime = now
+	b.setState(CircuitBreakerOpen, reason)
+	b.resetWindow(now)
+}
+
+// resetWindow new window
+func (b *circuitBreaker) resetWindow(now time.Time) {
+	b.windowTime = now
+	b.calls, b.failures, b.slowCalls = 0, 0, 0
+}
+
+// setState change state
+func (b *circuitBreaker) setState(state CircuitBreakerState, reason string) {
+	if b.state == state {
+		return
+	}
+	logrus.Printf("[info] circuit breaker %s %s : %s => %s %s", b.addr, b.method, b.state, state, reason)
+	b.state = state
+	b.reason = reason
+}
+
+// circuitBreakerError Unavailable with the open reasons in the details
+func circuitBreakerError(method string, reasons []string, retryDelay time.Duration) error {
+	s := status.New(codes.Unavailable, "circuit breaker open : "+method)
+	var details []proto.Message
+	for _, reason := range reasons {
+		details = append(details, &errdetails.ResourceInfo{
+			ResourceType: "circuit_breaker",
+			ResourceName: method,
+			Description:  reason,
+		})
+	}
+	details = append(details, &errdetails.RetryInfo{RetryDelay: ptypes.DurationProto(retryDelay)})
+	if ds, err := s.WithDetails(details...); err == nil {
+		s = ds
+	}
+	return s.Err()
+}
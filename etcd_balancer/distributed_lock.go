@@ -2,19 +2,30 @@ package balancer
 
 import (
 	"context"
+	"fmt"
 	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/rs/xid"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"os"
+	"strings"
 )
 
-// NewDistributedLock new lock
+// NewDistributedLock new lock, try once
 func NewDistributedLock(lockKey string) (*DistributedLock, error) {
 	return new(DistributedLock).GetLock(lockKey)
 }
 
+// NewBlockingDistributedLock new lock, blocks until get lock or ctx is done
+func NewBlockingDistributedLock(ctx context.Context, lockKey string) (*DistributedLock, error) {
+	return new(DistributedLock).Lock(ctx, lockKey)
+}
+
 // etcd distributed lock config
 const (
-	defaultLockAliveTTL int64 = 3 // etcd alive ttl(3s)
+	defaultLockAliveTTL int64 = 3      // etcd alive ttl(3s)
+	lockKeySeparator          = "\x00" // lock key & waiter key separator, not used in lock names
 )
 
 // err
@@ -22,16 +33,32 @@ var (
 	ErrLockInvalidLease    = status.Error(codes.Internal, "ETCDClient.Grant lease fail")
 	ErrLockCannotKeepAlive = status.Error(codes.Internal, "lockLease.KeepAlive fail")
 	ErrLockTxnCannotCommit = status.Error(codes.Internal, "ETCDClient.txn.Commit fail")
+	ErrLockInvalidGet      = status.Error(codes.Internal, "ETCDClient.Get fail")
 	ErrLockIsLocking       = status.Error(codes.Canceled, "get lock fail")
+	ErrLockWaitTimeout     = status.Error(codes.DeadlineExceeded, "wait lock timeout")
+	ErrLockWaitCanceled    = status.Error(codes.Canceled, "wait lock canceled")
+	ErrLockIsNotOwner      = status.Error(codes.FailedPrecondition, "lock is not owned")
+	ErrLockInvalidKey      = status.Error(codes.InvalidArgument, "lock key contains the separator")
 )
 
 // DistributedLock distributed lock
+//
+// every waiter puts lockKey\x00leaseId, the waiter with the lowest create
+// revision holds the lock and the others wait for their predecessor.
+//
+// the create revision is a monotonic fencing token, Lost is closed when the
+// lease keep alive stops.
 type DistributedLock struct {
 	ETCDClient   *clientv3.Client   // etcd client
 	LockKeyTTL   int64              // lock key etcd ttl
 	LockLease    clientv3.Lease     // lock lease
 	LockLeaseId  clientv3.LeaseID   // lock key ttl lease id
 	LockCancelFn context.CancelFunc // unlock
+	LockKey      string             // lock key prefix
+	LockMyKey    string             // lock key of this waiter
+	LockRevision int64              // lock key create revision
+	LockOwner    string             // lock value : host/pid/id
+	lostChan     chan struct{}      // lease keep alive stopped
 }
 
 // NewETCDClient etcd client
@@ -39,18 +66,114 @@ func (d *DistributedLock) NewETCDClient() {
 	d.ETCDClient = etcdClient
 }
 
-// UnLock unlock
-func (d *DistributedLock) UnLock() {
+// UnLock unlock, the lock key is deleted only if it is still owned
+func (d *DistributedLock) UnLock() (err error) {
+	// delete owned key
+	if len(d.LockMyKey) > 0 && d.ETCDClient != nil {
+		txtResp, txnErr := d.ETCDClient.Txn(context.TODO()).
+			If(d.isOwnerCmp()...).
+			Then(clientv3.OpDelete(d.LockMyKey)).
+			Commit()
+		if txnErr != nil {
+			err = ErrLockTxnCannotCommit
+		} else if !txtResp.Succeeded {
+			err = ErrLockIsNotOwner
+		}
+	}
 	// Revoke lease
-	d.LockLease.Revoke(context.TODO(), d.LockLeaseId)
+	if d.LockLease != nil {
+		d.LockLease.Revoke(context.TODO(), d.LockLeaseId)
+	}
 	// cancel lock
 	if d.LockCancelFn != nil {
 		d.LockCancelFn()
 	}
+	return err
+}
+
+// FencingToken monotonic token of the lock : the lock key create revision
+//
+// pass it to the protected resource, which rejects the tokens lower than the
+// last one it has seen.
+func (d *DistributedLock) FencingToken() int64 {
+	return d.LockRevision
+}
+
+// Lost closed when the lease keep alive stops : lease expired or unlocked
+func (d *DistributedLock) Lost() <-chan struct{} {
+	return d.lostChan
+}
+
+// IsOwner check the lock key is still owned
+func (d *DistributedLock) IsOwner(ctx context.Context) (bool, error) {
+	txtResp, err := d.ETCDClient.Txn(ctx).If(d.isOwnerCmp()...).Commit()
+	if err != nil {
+		return false, ErrLockTxnCannotCommit
+	}
+	return txtResp.Succeeded, nil
+}
+
+// isOwnerCmp lock key is owned
+func (d *DistributedLock) isOwnerCmp() []clientv3.Cmp {
+	return []clientv3.Cmp{
+		clientv3.Compare(clientv3.CreateRevision(d.LockMyKey), "=", d.LockRevision),
+		clientv3.Compare(clientv3.Value(d.LockMyKey), "=", d.LockOwner),
+	}
 }
 
-// GetLock get lock
+// TryLock get lock, try once
+func (d *DistributedLock) TryLock(lockKey string) (*DistributedLock, error) {
+	return d.GetLock(lockKey)
+}
+
+// GetLock get lock, try once
 func (d *DistributedLock) GetLock(lockKey string) (*DistributedLock, error) {
+	// lease
+	if err := d.grantAndKeepAlive(); err != nil {
+		return nil, err
+	}
+
+	// put waiter key
+	isOwner, err := d.enqueue(lockKey)
+	if err != nil {
+		d.UnLock()
+		return nil, err
+	}
+
+	// cannot get lock
+	if !isOwner {
+		d.UnLock()
+		return nil, ErrLockIsLocking
+	}
+	return d, nil
+}
+
+// Lock get lock, blocks until the predecessors unlock or ctx is done
+func (d *DistributedLock) Lock(ctx context.Context, lockKey string) (*DistributedLock, error) {
+	// lease
+	if err := d.grantAndKeepAlive(); err != nil {
+		return nil, err
+	}
+
+	// put waiter key
+	isOwner, err := d.enqueue(lockKey)
+	if err != nil {
+		d.UnLock()
+		return nil, err
+	}
+
+	// wait
+	if !isOwner {
+		if err := d.waitPredecessor(ctx, lockWaitPrefix(lockKey)); err != nil {
+			d.UnLock()
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// grantAndKeepAlive grant lock lease and keep alive
+func (d *DistributedLock) grantAndKeepAlive() error {
 	// client
 	if d.ETCDClient == nil {
 		d.NewETCDClient()
@@ -66,7 +189,7 @@ func (d *DistributedLock) GetLock(lockKey string) (*DistributedLock, error) {
 
 	// etcd ttl
 	if leaseResp, err := d.LockLease.Grant(context.TODO(), d.LockKeyTTL); err != nil {
-		return nil, ErrLockInvalidLease
+		return ErrLockInvalidLease
 	} else {
 		d.LockLeaseId = leaseResp.ID
 	}
@@ -76,9 +199,48 @@ func (d *DistributedLock) GetLock(lockKey string) (*DistributedLock, error) {
 	d.LockCancelFn = cancelFunc
 
 	// lease keep alive
-	if _, err := d.LockLease.KeepAlive(cancelCtx, d.LockLeaseId); err != nil {
+	leaseRespChan, err := d.LockLease.KeepAlive(cancelCtx, d.LockLeaseId)
+	if err != nil {
 		d.UnLock()
-		return nil, ErrLockCannotKeepAlive
+		return ErrLockCannotKeepAlive
+	}
+
+	// lease lost
+	d.lostChan = make(chan struct{})
+	go d.listenLeaseChan(leaseRespChan)
+	return nil
+}
+
+// newLockOwner lock value : host/pid/id
+func newLockOwner() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s/%d/%s", hostname, os.Getpid(), xid.New().String())
+}
+
+// lockWaitPrefix waiter key prefix of the lock
+//
+// the separator is not "/" : the waiters of lock "a" must not include the
+// waiters of lock "a/b"
+func lockWaitPrefix(lockKey string) string {
+	return lockKey + lockKeySeparator
+}
+
+// enqueue put the waiter key, returns whether it holds the lock
+func (d *DistributedLock) enqueue(lockKey string) (isOwner bool, err error) {
+	if strings.Contains(lockKey, lockKeySeparator) {
+		return false, ErrLockInvalidKey
+	}
+	d.LockKey = lockKey
+	waitPrefix := lockWaitPrefix(lockKey)
+	return d.enqueueKey(fmt.Sprintf("%s%x", waitPrefix, d.LockLeaseId), waitPrefix)
+}
+
+// enqueueKey put the waiter key, it holds the lock if no key under the wait
+// prefix was created before it
+func (d *DistributedLock) enqueueKey(myKey, waitPrefix string) (isOwner bool, err error) {
+	d.LockMyKey = myKey
+	if len(d.LockOwner) == 0 {
+		d.LockOwner = newLockOwner()
 	}
 
 	// lock key value
@@ -87,27 +249,109 @@ func (d *DistributedLock) GetLock(lockKey string) (*DistributedLock, error) {
 	// start transaction
 	txn := kv.Txn(context.TODO())
 
-	txn.If(clientv3.Compare(clientv3.CreateRevision(lockKey), "=", 0)).
-		Then(clientv3.OpPut(lockKey, "locking", clientv3.WithLease(d.LockLeaseId))).
-		Else(clientv3.OpGet(lockKey))
+	// the first waiter
+	getOwnerOp := clientv3.OpGet(waitPrefix, clientv3.WithFirstCreate()...)
+
+	txn.If(clientv3.Compare(clientv3.CreateRevision(d.LockMyKey), "=", 0)).
+		Then(clientv3.OpPut(d.LockMyKey, d.LockOwner, clientv3.WithLease(d.LockLeaseId)), getOwnerOp).
+		Else(clientv3.OpGet(d.LockMyKey), getOwnerOp)
 
 	// commit transaction
-	if txtResp, err := txn.Commit(); err != nil {
-		d.UnLock()
-		return nil, ErrLockTxnCannotCommit
-	} else {
-		// cannot get lock
-		if !txtResp.Succeeded {
-			d.UnLock()
-			//logrus.Println("is locking ：", string(txtResp.Responses[0].GetResponseRange().Kvs[0].Value))
-			return nil, ErrLockIsLocking
+	txtResp, err := txn.Commit()
+	if err != nil {
+		return false, ErrLockTxnCannotCommit
+	}
+
+	// create revision
+	d.LockRevision = txtResp.Header.Revision
+	if !txtResp.Succeeded {
+		d.LockRevision = txtResp.Responses[0].GetResponseRange().Kvs[0].CreateRevision
+	}
+
+	// owner
+	ownerKvs := txtResp.Responses[1].GetResponseRange().Kvs
+	isOwner = len(ownerKvs) == 0 || ownerKvs[0].CreateRevision >= d.LockRevision
+	return isOwner, nil
+}
+
+// waitPredecessor wait until all waiters under the prefix before this one are deleted
+//
+// the waiter key is checked together with the predecessors : the lock is not
+// held if the waiter lease expired while waiting
+func (d *DistributedLock) waitPredecessor(ctx context.Context, waitPrefix string) error {
+	for {
+		// the last waiter before this one
+		getOpts := append(clientv3.WithLastCreate(), clientv3.WithMaxCreateRev(d.LockRevision-1))
+		txnResp, err := d.ETCDClient.Txn(ctx).
+			If(d.isOwnerCmp()...).
+			Then(clientv3.OpGet(waitPrefix, getOpts...)).
+			Commit()
+		if err != nil {
+			return d.waitError(ctx, ErrLockInvalidGet)
+		}
+
+		// waiter key deleted
+		if !txnResp.Succeeded {
+			return ErrLockIsNotOwner
+		}
+
+		// is owner
+		kvs := txnResp.Responses[0].GetResponseRange().Kvs
+		if len(kvs) == 0 {
+			return nil
+		}
+
+		// wait predecessor delete
+		if err := d.waitDelete(ctx, string(kvs[0].Key), txnResp.Header.Revision); err != nil {
+			return err
 		}
 	}
-	return d, nil
 }
 
-// listenLeaseChan listen lease
+// waitDelete wait key delete after revision
+//
+// returns nil when the watch is closed or compacted, the caller gets the
+// predecessor again from the current revision
+func (d *DistributedLock) waitDelete(ctx context.Context, key string, revision int64) error {
+	watchCtx, watchCancelFn := context.WithCancel(ctx)
+	defer watchCancelFn()
+
+	watchChan := d.ETCDClient.Watch(watchCtx, key, clientv3.WithRev(revision+1))
+	for {
+		select {
+		case <-d.lostChan:
+			return ErrLockIsNotOwner
+
+		case watchResp, ok := <-watchChan:
+			if !ok || watchResp.Err() != nil {
+				if ctx.Err() != nil {
+					return d.waitError(ctx, ErrLockIsLocking)
+				}
+				return nil
+			}
+			for _, ev := range watchResp.Events {
+				if ev.Type == mvccpb.DELETE {
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// waitError ctx error or err
+func (d *DistributedLock) waitError(ctx context.Context, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return ErrLockWaitTimeout
+	case context.Canceled:
+		return ErrLockWaitCanceled
+	}
+	return err
+}
+
+// listenLeaseChan listen lease, close lost chan when keep alive stops
 func (d *DistributedLock) listenLeaseChan(leaseRespChan <-chan *clientv3.LeaseKeepAliveResponse) {
+	defer close(d.lostChan)
 	for {
 		select {
 		case leaseKeepResp := <-leaseRespChan:
@@ -0,0 +1,367 @@
+package balancer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// NewElection new election
+func NewElection(electionName, value string) *Election {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	return &Election{
+		ETCDClient:  etcdClient,
+		ElectionKey: "election/" + electionName + "/",
+		ElectionTTL: defaultElectionAliveTTL,
+		Value:       value,
+		ctx:         ctx,
+		cancelFn:    cancelFn,
+		doneChan:    make(chan struct{}),
+	}
+}
+
+// etcd election config
+const (
+	defaultElectionAliveTTL      int64 = 5               // etcd alive ttl(5s)
+	defaultElectionRetryInterval       = time.Second     // re-campaign interval
+	defaultElectionResignTimeout       = 3 * time.Second // resign timeout
+)
+
+// err
+var (
+	ErrElectionInvalidSession = status.Error(codes.Internal, "concurrency.NewSession fail")
+	ErrElectionCannotCampaign = status.Error(codes.Internal, "election.Campaign fail")
+	ErrElectionCannotResign   = status.Error(codes.Internal, "election.Resign fail")
+	ErrElectionInvalidLeader  = status.Error(codes.Internal, "election.Leader fail")
+	ErrElectionNoLeader       = status.Error(codes.NotFound, "election no leader")
+)
+
+// Election leader election, one leader per election key
+//
+// Run campaigns until stop : OnElected is called with a context which is done
+// when the leadership is lost, the leader lease expires then another instance
+// is elected.
+type Election struct {
+	ETCDClient  *clientv3.Client // etcd client
+	ElectionKey string           // etcd key prefix
+	ElectionTTL int64            // election lease etcd ttl
+	Value       string           // campaign value
+
+	OnElected       func(ctx context.Context) // elected, ctx is done when the leadership is lost
+	OnLeaderChanged func(leader string)       // leader value changed
+
+	mutex    sync.Mutex
+	session  *concurrency.Session
+	election *concurrency.Election
+	isLeader bool
+	resignFn context.CancelFunc // end current term of Run
+	ctx      context.Context
+	cancelFn context.CancelFunc
+	doneChan chan struct{}
+	runOnce  sync.Once
+	stopOnce sync.Once
+}
+
+// getElection election with a live session
+func (e *Election) getElection() (*concurrency.Election, *concurrency.Session, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	// session alive
+	if e.session != nil {
+		select {
+		case <-e.session.Done():
+		default:
+			return e.election, e.session, nil
+		}
+	}
+
+	// client
+	if e.ETCDClient == nil {
+		e.ETCDClient = etcdClient
+	}
+
+	// etcd ttl
+	if e.ElectionTTL <= 0 {
+		e.ElectionTTL = defaultElectionAliveTTL
+	}
+
+	session, err := concurrency.NewSession(e.ETCDClient, concurrency.WithTTL(int(e.ElectionTTL)), concurrency.WithContext(e.ctx))
+	if err != nil {
+		return nil, nil, ErrElectionInvalidSession
+	}
+	e.session = session
+	e.election = concurrency.NewElection(session, e.ElectionKey)
+	e.isLeader = false
+	return e.election, e.session, nil
+}
+
+// Campaign blocks until elected or ctx is done
+func (e *Election) Campaign(ctx context.Context) error {
+	election, session, err := e.getElection()
+	if err != nil {
+		return err
+	}
+
+	if err := election.Campaign(ctx, e.Value); err != nil {
+		return ErrElectionCannotCampaign
+	}
+	e.setLeader(session, true)
+
+	// lease lost
+	go func() {
+		<-session.Done()
+		e.setLeader(session, false)
+	}()
+	return nil
+}
+
+// Resign give up the leadership, another instance is elected
+func (e *Election) Resign(ctx context.Context) error {
+	e.mutex.Lock()
+	election, resignFn := e.election, e.resignFn
+	e.isLeader = false
+	e.mutex.Unlock()
+
+	if election == nil {
+		return nil
+	}
+	if err := election.Resign(ctx); err != nil {
+		return ErrElectionCannotResign
+	}
+
+	// end current term of Run
+	if resignFn != nil {
+		resignFn()
+	}
+	return nil
+}
+
+// IsLeader is leader
+func (e *Election) IsLeader() bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.isLeader
+}
+
+// Leader current leader value
+func (e *Election) Leader(ctx context.Context) (string, error) {
+	election, _, err := e.getElection()
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := election.Leader(ctx)
+	if err == concurrency.ErrElectionNoLeader {
+		return "", ErrElectionNoLeader
+	} else if err != nil {
+		return "", ErrElectionInvalidLeader
+	}
+	return string(resp.Kvs[0].Value), nil
+}
+
+// Observe leader value changes, closed when ctx is done
+func (e *Election) Observe(ctx context.Context) <-chan string {
+	leaderChan := make(chan string)
+
+	go func() {
+		defer close(leaderChan)
+
+		election, _, err := e.getElection()
+		if err != nil {
+			logrus.Errorf("Election.Observe error : %v", err)
+			return
+		}
+
+		var leader string
+		for resp := range election.Observe(ctx) {
+			if len(resp.Kvs) == 0 || string(resp.Kvs[0].Value) == leader {
+				continue
+			}
+			leader = string(resp.Kvs[0].Value)
+			select {
+			case leaderChan <- leader:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return leaderChan
+}
+
+// Run campaign until stop, re-campaign when the leadership is lost
+func (e *Election) Run() {
+	e.runOnce.Do(func() {
+		go e.run()
+	})
+}
+
+// Done closed after Run stopped
+func (e *Election) Done() <-chan struct{} {
+	return e.doneChan
+}
+
+// Stop stop campaign and revoke the election lease
+func (e *Election) Stop() {
+	e.stopOnce.Do(func() {
+		e.cancelFn()
+
+		// wait run
+		var isRunning = true
+		e.runOnce.Do(func() { isRunning = false })
+		if isRunning {
+			<-e.doneChan
+		} else {
+			close(e.doneChan)
+		}
+
+		// revoke lease
+		e.mutex.Lock()
+		if e.session != nil {
+			ctx, cancelFn := context.WithTimeout(context.Background(), defaultElectionResignTimeout)
+			if _, err := e.ETCDClient.Revoke(ctx, e.session.Lease()); err != nil {
+				logrus.Errorf("[E] etcdClient.Revoke error : %v", err)
+			}
+			cancelFn()
+		}
+		e.isLeader = false
+		e.mutex.Unlock()
+	})
+}
+
+// run campaign loop
+func (e *Election) run() {
+	defer close(e.doneChan)
+
+	// leader changed
+	if e.OnLeaderChanged != nil {
+		go func() {
+			for leader := range e.Observe(e.ctx) {
+				e.OnLeaderChanged(leader)
+			}
+		}()
+	}
+
+	for {
+		if err := e.runTerm(); err != nil {
+			logrus.Errorf("Election.runTerm error : %v", err)
+		}
+
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-time.After(defaultElectionRetryInterval):
+		}
+	}
+}
+
+// runTerm campaign and hold the leadership until it is lost
+func (e *Election) runTerm() error {
+	if err := e.Campaign(e.ctx); err != nil {
+		return err
+	}
+
+	e.mutex.Lock()
+	session := e.session
+	termCtx, termCancelFn := context.WithCancel(e.ctx)
+	e.resignFn = termCancelFn
+	e.mutex.Unlock()
+	defer termCancelFn()
+
+	// lease lost
+	go func() {
+		select {
+		case <-session.Done():
+			termCancelFn()
+		case <-termCtx.Done():
+		}
+	}()
+
+	logrus.Printf("[info] election elected : %s%s", e.ElectionKey, e.Value)
+	if e.OnElected != nil {
+		e.OnElected(termCtx)
+	}
+	<-termCtx.Done()
+	logrus.Printf("[info] election leadership lost : %s%s", e.ElectionKey, e.Value)
+
+	// resign : stopped or Resign called, the session is still alive
+	select {
+	case <-session.Done():
+	default:
+		ctx, cancelFn := context.WithTimeout(context.Background(), defaultElectionResignTimeout)
+		e.Resign(ctx)
+		cancelFn()
+	}
+	return nil
+}
+
+// getSession current session
+func (e *Election) getSession() *concurrency.Session {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.session
+}
+
+// endTerm end current term of Run, the leadership is resigned
+func (e *Election) endTerm() {
+	e.mutex.Lock()
+	resignFn := e.resignFn
+	e.mutex.Unlock()
+	if resignFn != nil {
+		resignFn()
+	}
+}
+
+// setLeader set leader of the session
+func (e *Election) setLeader(session *concurrency.Session, isLeader bool) {
+	e.mutex.Lock()
+	if e.session == session {
+		e.isLeader = isLeader
+	}
+	e.mutex.Unlock()
+}
+
+// RegisterLeaderServer register server to etcd only while holding the leadership
+//
+// one instance of the server is registered, another instance takes over when
+// the leader lease expires
+func RegisterLeaderServer(serverAddr string) (*Election, error) {
+	e := NewElection(serverConfig.SchemaName+"/"+serverConfig.ServerName, serverAddr)
+	e.ElectionTTL = serverConfig.ETCDAliveTTL
+
+	// register while leader : the server key is put with the election lease,
+	// it expires together with the leadership
+	e.OnElected = func(ctx context.Context) {
+		session := e.getSession()
+		if session == nil {
+			return
+		}
+		serverKey := getServerETCDKey(serverConfig, serverAddr)
+		logrus.Printf("[info] etcd key : %v\n", serverKey)
+		if _, err := e.ETCDClient.Put(ctx, serverKey, serverAddr, clientv3.WithLease(session.Lease())); err != nil {
+			logrus.Errorf("[E] etcdClient.Put error : %v", err)
+
+			// not registered : end the term, the leadership is resigned and
+			// campaigned again
+			e.endTerm()
+			return
+		}
+		<-ctx.Done()
+
+		// resigned : the session lease is still alive
+		delCtx, cancelFn := context.WithTimeout(context.Background(), defaultElectionResignTimeout)
+		if _, err := e.ETCDClient.Delete(delCtx, serverKey); err != nil {
+			logrus.Errorf("[E] etcdClient.Delete error : %v", err)
+		}
+		cancelFn()
+	}
+
+	e.Run()
+	return e, nil
+}
@@ -0,0 +1,66 @@
+//go:build integration
+// +build integration
+
+package balancer
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/embed"
+	"github.com/sirupsen/logrus"
+)
+
+// embed etcd of the tests
+//
+// go test -tags integration ./etcd_balancer/
+const (
+	testETCDClientURL = "http://127.0.0.1:23790" // client url
+	testETCDPeerURL   = "http://127.0.0.1:23800" // peer url
+)
+
+// the package init dials etcd before TestMain : dial without blocking,
+// the client connects after the embed etcd is ready
+var _ = func() bool {
+	DefaultETCDConfigFn = func() {
+		SetETCDConfig(&clientv3.Config{Endpoints: []string{testETCDClientURL}})
+	}
+	return true
+}()
+
+// TestMain start the embed etcd
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "bh_etcd_test")
+	if err != nil {
+		logrus.Panicf("ioutil.TempDir error : %v", err)
+	}
+
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	clientURL, _ := url.Parse(testETCDClientURL)
+	peerURL, _ := url.Parse(testETCDPeerURL)
+	cfg.LCUrls, cfg.ACUrls = []url.URL{*clientURL}, []url.URL{*clientURL}
+	cfg.LPUrls, cfg.APUrls = []url.URL{*peerURL}, []url.URL{*peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		logrus.Panicf("embed.StartEtcd error : %v", err)
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		e.Server.Stop()
+		logrus.Panic("embed etcd start timeout")
+	}
+
+	code := m.Run()
+
+	e.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
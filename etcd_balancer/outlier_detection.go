@@ -0,0 +1,265 @@
+package balancer
+
+import (
+	"expvar"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// OutlierDetectionBalancerName balancer name
+const OutlierDetectionBalancerName = "bh_outlier_detection"
+
+// outlier detection config
+const (
+	defaultOutlierConsecutiveErrors  = 5                // consecutive errors => eject
+	defaultOutlierLatencyMultiplier  = 3.0              // mean latency > multiplier * pool median => eject
+	defaultOutlierLatencyMinRequests = 10               // minimum calls per interval for the latency
+	defaultOutlierInterval           = 10 * time.Second // latency interval
+	defaultOutlierBaseEjectionTime   = 30 * time.Second // ejection time * ejection count
+	defaultOutlierMaxEjectionTime    = 5 * time.Minute  // max ejection time
+	defaultOutlierMaxEjectionPercent = 10               // max ejected hosts percent of the pool
+)
+
+// outlier detection metrics
+var (
+	outlierEjectionsVar = expvar.NewMap("bh_outlier_ejections_total") // addr => ejections
+	outlierEjectedVar   = expvar.NewMap("bh_outlier_ejected")         // addr => 1 ejected, 0 not ejected
+)
+
+// OutlierDetectionConfig outlier detection config
+type OutlierDetectionConfig struct {
+	ConsecutiveErrors  int           // consecutive error codes before ejection
+	ErrorCodes         []codes.Code  // 5xx equivalent codes, default Unknown, Internal, Unavailable, DataLoss, DeadlineExceeded
+	LatencyMultiplier  float64       // eject when the mean latency > multiplier * pool median
+	LatencyMinRequests int           // minimum calls per interval for the latency
+	Interval           time.Duration // latency interval
+	BaseEjectionTime   time.Duration // ejection time = base * ejection count
+	MaxEjectionTime    time.Duration // max ejection time
+	MaxEjectionPercent int           // max ejected hosts percent of the pool, one host at least
+}
+
+// init default config
+func (cfg *OutlierDetectionConfig) init() {
+	if cfg.ConsecutiveErrors <= 0 {
+		cfg.ConsecutiveErrors = defaultOutlierConsecutiveErrors
+	}
+	if len(cfg.ErrorCodes) == 0 {
+		cfg.ErrorCodes = []codes.Code{codes.Unknown, codes.Internal, codes.Unavailable, codes.DataLoss, codes.DeadlineExceeded}
+	}
+	if cfg.LatencyMultiplier <= 1 {
+		cfg.LatencyMultiplier = defaultOutlierLatencyMultiplier
+	}
+	if cfg.LatencyMinRequests <= 0 {
+		cfg.LatencyMinRequests = defaultOutlierLatencyMinRequests
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultOutlierInterval
+	}
+	if cfg.BaseEjectionTime <= 0 {
+		cfg.BaseEjectionTime = defaultOutlierBaseEjectionTime
+	}
+	if cfg.MaxEjectionTime <= 0 {
+		cfg.MaxEjectionTime = defaultOutlierMaxEjectionTime
+	}
+	if cfg.MaxEjectionPercent <= 0 || cfg.MaxEjectionPercent > 100 {
+		cfg.MaxEjectionPercent = defaultOutlierMaxEjectionPercent
+	}
+}
+
+// isError 5xx equivalent code
+func (cfg *OutlierDetectionConfig) isError(err error) bool {
+	if err == nil {
+		return false
+	}
+	code := status.Code(err)
+	for _, c := range cfg.ErrorCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// RegisterOutlierDetectionBalancer register the round robin balancer with
+// outlier detection per address
+func RegisterOutlierDetectionBalancer(cfg *OutlierDetectionConfig) {
+	if cfg == nil {
+		cfg = &OutlierDetectionConfig{}
+	}
+	RegisterBalancer(OutlierDetectionBalancerName, nil, cfg)
+}
+
+// outlierHost address statistics
+type outlierHost struct {
+	addr              string
+	consecutiveErrors int
+	ejectionCount     int       // growing ejection time, decreased by the healthy intervals
+	ejectedUntil      time.Time // zero : not ejected
+	latencySum        time.Duration
+	latencyCount      int
+}
+
+// outlierDetector passive outlier detection of a client conn, shared by its pickers
+type outlierDetector struct {
+	config *OutlierDetectionConfig
+
+	mutex        sync.Mutex
+	hostMap      map[string]*outlierHost
+	poolSize     int
+	intervalTime time.Time
+}
+
+// newOutlierDetector outlier detector
+func newOutlierDetector(cfg *OutlierDetectionConfig) *outlierDetector {
+	cfg.init()
+	return &outlierDetector{
+		config:       cfg,
+		hostMap:      make(map[string]*outlierHost),
+		intervalTime: time.Now(),
+	}
+}
+
+// setHosts resolved addresses of the pool, the hosts removed by the resolver
+// are dropped : they are not counted by the max ejection percent
+func (d *outlierDetector) setHosts(addrs []string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.poolSize = len(addrs)
+	addrMap := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		addrMap[addr] = true
+		if _, ok := d.hostMap[addr]; !ok {
+			d.hostMap[addr] = &outlierHost{addr: addr}
+		}
+	}
+
+	// removed
+	for addr, host := range d.hostMap {
+		if addrMap[addr] {
+			continue
+		}
+		if !host.ejectedUntil.IsZero() {
+			outlierEjectedVar.Add(addr, -1)
+		}
+		delete(d.hostMap, addr)
+	}
+}
+
+// isEjected ejected address, the expired ejection is returned to the pool
+func (d *outlierDetector) isEjected(addr string, now time.Time) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	host, ok := d.hostMap[addr]
+	if !ok || host.ejectedUntil.IsZero() {
+		return false
+	}
+	if now.Before(host.ejectedUntil) {
+		return true
+	}
+	d.unEject(host)
+	return false
+}
+
+// done record the call result
+func (d *outlierDetector) done(addr string, now time.Time, duration time.Duration, err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	host, ok := d.hostMap[addr]
+	if !ok {
+		return
+	}
+
+	// consecutive errors
+	if d.config.isError(err) {
+		host.consecutiveErrors++
+		if host.consecutiveErrors >= d.config.ConsecutiveErrors && host.ejectedUntil.IsZero() {
+			d.eject(host, now, "consecutive errors "+status.Code(err).String())
+		}
+	} else {
+		host.consecutiveErrors = 0
+		host.latencySum += duration
+		host.latencyCount++
+	}
+
+	// latency outliers
+	if now.Sub(d.intervalTime) >= d.config.Interval {
+		d.evaluateLatency(now)
+	}
+}
+
+// evaluateLatency eject the hosts slower than multiplier * pool median
+func (d *outlierDetector) evaluateLatency(now time.Time) {
+	d.intervalTime = now
+
+	var means []time.Duration
+	meanMap := make(map[*outlierHost]time.Duration)
+	for _, host := range d.hostMap {
+		if host.ejectedUntil.IsZero() && host.latencyCount >= d.config.LatencyMinRequests {
+			mean := host.latencySum / time.Duration(host.latencyCount)
+			means = append(means, mean)
+			meanMap[host] = mean
+		} else if host.ejectedUntil.IsZero() && host.ejectionCount > 0 {
+			// healthy interval
+			host.ejectionCount--
+		}
+		host.latencySum, host.latencyCount = 0, 0
+	}
+	if len(means) < 2 {
+		return
+	}
+	sort.Slice(means, func(i, j int) bool { return means[i] < means[j] })
+	median := means[len(means)/2]
+	threshold := time.Duration(float64(median) * d.config.LatencyMultiplier)
+	for host, mean := range meanMap {
+		if mean > threshold {
+			d.eject(host, now, "latency "+mean.String()+" > "+threshold.String())
+		} else if host.ejectionCount > 0 {
+			host.ejectionCount--
+		}
+	}
+}
+
+// eject host, capped at max ejection percent of the pool
+func (d *outlierDetector) eject(host *outlierHost, now time.Time, reason string) {
+	ejected := 0
+	for _, h := range d.hostMap {
+		if !h.ejectedUntil.IsZero() && now.Before(h.ejectedUntil) {
+			ejected++
+		}
+	}
+	maxEjected := d.poolSize * d.config.MaxEjectionPercent / 100
+	if maxEjected < 1 {
+		maxEjected = 1
+	}
+	if ejected >= maxEjected || ejected+1 >= d.poolSize {
+		logrus.Warnf("[warn] outlier %s not ejected : %s, ejected %d of %d", host.addr, reason, ejected, d.poolSize)
+		return
+	}
+
+	host.ejectionCount++
+	ejectionTime := d.config.BaseEjectionTime * time.Duration(host.ejectionCount)
+	if ejectionTime > d.config.MaxEjectionTime {
+		ejectionTime = d.config.MaxEjectionTime
+	}
+	host.ejectedUntil = now.Add(ejectionTime)
+	host.consecutiveErrors = 0
+
+	outlierEjectionsVar.Add(host.addr, 1)
+	outlierEjectedVar.Add(host.addr, 1)
+	logrus.Warnf("[warn] outlier %s ejected for %v : %s, ejection count %d", host.addr, ejectionTime, reason, host.ejectionCount)
+}
+
+// unEject return host to the pool
+func (d *outlierDetector) unEject(host *outlierHost) {
+	host.ejectedUntil = time.Time{}
+	outlierEjectedVar.Add(host.addr, -1)
+	logrus.Printf("[info] outlier %s returned to the pool", host.addr)
+}
@@ -0,0 +1,216 @@
+package balancer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	gbalancer "google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+)
+
+// RegisterBalancer register the round robin balancer, with circuit breakers
+// per address and per method and / or outlier detection per address
+//
+// nil config : disabled
+func RegisterBalancer(name string, breakerCfg *CircuitBreakerConfig, outlierCfg *OutlierDetectionConfig) {
+	if breakerCfg != nil {
+		breakerCfg.init()
+	}
+	if outlierCfg != nil {
+		outlierCfg.init()
+	}
+	gbalancer.Register(&balancerBuilder{
+		name:          name,
+		breakerConfig: breakerCfg,
+		outlierConfig: outlierCfg,
+	})
+}
+
+// balancerBuilder base balancer per client conn, with its own breakers &
+// outlier hosts
+type balancerBuilder struct {
+	name          string
+	breakerConfig *CircuitBreakerConfig
+	outlierConfig *OutlierDetectionConfig
+}
+
+// Build base balancer, the resolved addresses are tracked by the picker builder
+func (bb *balancerBuilder) Build(cc gbalancer.ClientConn, opts gbalancer.BuildOptions) gbalancer.Balancer {
+	pb := &pickerBuilder{
+		breakerConfig: bb.breakerConfig,
+		breakerMap:    new(sync.Map),
+	}
+	if bb.outlierConfig != nil {
+		pb.outlier = newOutlierDetector(bb.outlierConfig)
+	}
+	b := base.NewBalancerBuilderWithConfig(bb.name, pb, base.Config{HealthCheck: true}).Build(cc, opts)
+	return &poolBalancer{V2Balancer: b.(gbalancer.V2Balancer), balancer: b, builder: pb}
+}
+
+// Name balancer name
+func (bb *balancerBuilder) Name() string {
+	return bb.name
+}
+
+// poolBalancer base balancer, the addresses removed by the resolver are
+// dropped from the breakers & outlier hosts
+type poolBalancer struct {
+	gbalancer.V2Balancer
+	balancer gbalancer.Balancer
+	builder  *pickerBuilder
+}
+
+// UpdateClientConnState resolved addresses
+func (b *poolBalancer) UpdateClientConnState(s gbalancer.ClientConnState) error {
+	b.builder.setPool(s.ResolverState.Addresses)
+	return b.V2Balancer.UpdateClientConnState(s)
+}
+
+// HandleSubConnStateChange deprecated, not called by grpc on a V2Balancer
+func (b *poolBalancer) HandleSubConnStateChange(sc gbalancer.SubConn, state connectivity.State) {
+	b.balancer.HandleSubConnStateChange(sc, state)
+}
+
+// HandleResolvedAddrs deprecated, not called by grpc on a V2Balancer
+func (b *poolBalancer) HandleResolvedAddrs(addrs []resolver.Address, err error) {
+	b.balancer.HandleResolvedAddrs(addrs, err)
+}
+
+// pickerBuilder picker builder, the breakers & outlier hosts outlive the pickers
+type pickerBuilder struct {
+	breakerConfig *CircuitBreakerConfig // nil : without circuit breakers
+	breakerMap    *sync.Map             // addr + method => *circuitBreaker
+	outlier       *outlierDetector      // nil : without outlier detection
+}
+
+// Build picker of the ready sub conns
+func (pb *pickerBuilder) Build(readySCs map[resolver.Address]gbalancer.SubConn) gbalancer.Picker {
+	p := &picker{builder: pb}
+	for addr, sc := range readySCs {
+		p.addrs = append(p.addrs, addr.Addr)
+		p.subConns = append(p.subConns, sc)
+	}
+	if len(p.subConns) == 0 {
+		return base.NewErrPicker(gbalancer.ErrNoSubConnAvailable)
+	}
+	p.next = int(time.Now().UnixNano() % int64(len(p.subConns)))
+	return p
+}
+
+// setPool resolved addresses : the breakers & outlier hosts of the removed
+// addresses are dropped, a not ready address is kept
+func (pb *pickerBuilder) setPool(resolved []resolver.Address) {
+	addrs := make([]string, 0, len(resolved))
+	for _, addr := range resolved {
+		addrs = append(addrs, addr.Addr)
+	}
+	pb.pruneBreakers(addrs)
+	if pb.outlier != nil {
+		pb.outlier.setHosts(addrs)
+	}
+}
+
+// pruneBreakers delete the breakers of the addresses not in the pool
+func (pb *pickerBuilder) pruneBreakers(addrs []string) {
+	addrMap := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		addrMap[addr] = true
+	}
+	pb.breakerMap.Range(func(key, value interface{}) bool {
+		if !addrMap[value.(*circuitBreaker).addr] {
+			pb.breakerMap.Delete(key)
+		}
+		return true
+	})
+}
+
+// breaker address & method circuit breaker
+func (pb *pickerBuilder) breaker(addr, method string) *circuitBreaker {
+	key := addr + method
+	if b, ok := pb.breakerMap.Load(key); ok {
+		return b.(*circuitBreaker)
+	}
+	b, _ := pb.breakerMap.LoadOrStore(key, &circuitBreaker{
+		config:     pb.breakerConfig,
+		addr:       addr,
+		method:     method,
+		windowTime: time.Now(),
+	})
+	return b.(*circuitBreaker)
+}
+
+// picker round robin, skip the ejected outliers & the open circuit breakers
+type picker struct {
+	builder  *pickerBuilder
+	addrs    []string
+	subConns []gbalancer.SubConn
+
+	mutex sync.Mutex
+	next  int
+}
+
+// Pick sub conn
+func (p *picker) Pick(ctx context.Context, opts gbalancer.PickInfo) (gbalancer.SubConn, func(gbalancer.DoneInfo), error) {
+	p.mutex.Lock()
+	start := p.next
+	p.next = (p.next + 1) % len(p.subConns)
+	p.mutex.Unlock()
+
+	var (
+		now        = time.Now()
+		outlier    = p.builder.outlier
+		reasons    []string
+		retryDelay time.Duration
+		ejected    = -1
+	)
+	for i := 0; i < len(p.subConns); i++ {
+		index := (start + i) % len(p.subConns)
+		addr := p.addrs[index]
+
+		// ejected outlier
+		if outlier != nil && outlier.isEjected(addr, now) {
+			if ejected < 0 {
+				ejected = index
+			}
+			continue
+		}
+
+		// circuit breaker
+		var b *circuitBreaker
+		if p.builder.breakerConfig != nil {
+			b = p.builder.breaker(addr, opts.FullMethodName)
+			ok, reason, delay := b.allow(now)
+			if !ok {
+				reasons = append(reasons, addr+" : "+reason)
+				if retryDelay == 0 || delay < retryDelay {
+					retryDelay = delay
+				}
+				continue
+			}
+		}
+
+		return p.subConns[index], p.doneFn(now, addr, b), nil
+	}
+
+	// all ejected : the ejection is capped by the pool, the pool changed
+	if len(reasons) == 0 && ejected >= 0 {
+		return p.subConns[ejected], p.doneFn(now, p.addrs[ejected], nil), nil
+	}
+	return nil, nil, circuitBreakerError(opts.FullMethodName, reasons, retryDelay)
+}
+
+// doneFn record the call result
+func (p *picker) doneFn(pickTime time.Time, addr string, b *circuitBreaker) func(gbalancer.DoneInfo) {
+	return func(info gbalancer.DoneInfo) {
+		doneTime := time.Now()
+		if b != nil {
+			b.done(doneTime, doneTime.Sub(pickTime), info.Err)
+		}
+		if outlier := p.builder.outlier; outlier != nil {
+			outlier.done(addr, doneTime, doneTime.Sub(pickTime), info.Err)
+		}
+	}
+}
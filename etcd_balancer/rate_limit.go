@@ -0,0 +1,159 @@
+package balancer
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// cluster rate limit config
+const (
+	defaultRateLimitKeyPrefix  = "rate_limit/" // etcd key prefix : rate_limit/{key}
+	defaultRateLimitRetryTimes = 5             // compare and swap retry times
+)
+
+// err
+var (
+	ErrRateLimitInvalidLease = status.Error(codes.Internal, "ETCDClient.Grant lease fail")
+	ErrRateLimitInvalidTxn   = status.Error(codes.Internal, "ETCDClient.Txn fail")
+)
+
+// ClusterRateLimiter token buckets shared by the instances
+//
+// a bucket is one etcd key with the tokens and the refill time, it is updated
+// by compare and swap. the key expires once the bucket would be refilled to
+// full, a missing key is a full bucket.
+//
+// every instance must use the same rate & burst of a key.
+type ClusterRateLimiter struct {
+	ETCDClient *clientv3.Client // etcd client
+	KeyPrefix  string           // etcd key prefix
+
+	mutex    sync.Mutex
+	leaseMap map[int64]*clusterRateLimitLease // key ttl => lease
+}
+
+// clusterRateLimitLease lease shared by the keys of the same ttl, granted with
+// twice the ttl and replaced when less than the ttl is left
+type clusterRateLimitLease struct {
+	id       clientv3.LeaseID
+	expireAt time.Time
+}
+
+// clusterTokenBucket bucket value
+type clusterTokenBucket struct {
+	Tokens float64 `json:"tokens"` // tokens left
+	Last   int64   `json:"last"`   // unix nano of the last refill
+}
+
+// NewClusterRateLimiter cluster rate limiter
+func NewClusterRateLimiter() *ClusterRateLimiter {
+	return &ClusterRateLimiter{
+		ETCDClient: etcdClient,
+		KeyPrefix:  defaultRateLimitKeyPrefix,
+		leaseMap:   make(map[int64]*clusterRateLimitLease),
+	}
+}
+
+// Take take up to n tokens of the bucket, returns the granted tokens, and the
+// delay until a token is refilled if none is granted
+//
+// rate : tokens per second, greater than 0; burst : bucket size
+func (l *ClusterRateLimiter) Take(ctx context.Context, key string, rate, burst float64, n int) (granted int, retryAfter time.Duration, err error) {
+	etcdKey := l.KeyPrefix + key
+	ttl := int64(math.Ceil(burst/rate)) + 1
+
+	getResp, err := l.ETCDClient.Get(ctx, etcdKey)
+	if err != nil {
+		return 0, 0, ErrRateLimitInvalidTxn
+	}
+	kvs := getResp.Kvs
+	for i := 0; i < defaultRateLimitRetryTimes; i++ {
+		// current bucket, full if missing
+		now := time.Now()
+		bucket := &clusterTokenBucket{Tokens: burst, Last: now.UnixNano()}
+		var modRevision int64
+		if len(kvs) > 0 {
+			modRevision = kvs[0].ModRevision
+			if err := json.Unmarshal(kvs[0].Value, bucket); err != nil {
+				bucket = &clusterTokenBucket{Tokens: burst, Last: now.UnixNano()}
+			}
+		}
+
+		// refill
+		if elapsed := now.UnixNano() - bucket.Last; elapsed > 0 {
+			bucket.Tokens = math.Min(burst, bucket.Tokens+float64(elapsed)/float64(time.Second)*rate)
+			bucket.Last = now.UnixNano()
+		}
+
+		// no token
+		granted = int(math.Min(float64(n), math.Floor(bucket.Tokens)))
+		if granted <= 0 {
+			return 0, time.Duration((1 - bucket.Tokens) / rate * float64(time.Second)), nil
+		}
+		bucket.Tokens -= float64(granted)
+
+		// compare and swap, the key of a missing bucket has mod revision 0
+		leaseID, err := l.lease(ctx, ttl)
+		if err != nil {
+			return 0, 0, err
+		}
+		value, _ := json.Marshal(bucket)
+		txnResp, err := l.ETCDClient.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(etcdKey), "=", modRevision)).
+			Then(clientv3.OpPut(etcdKey, string(value), clientv3.WithLease(leaseID))).
+			Else(clientv3.OpGet(etcdKey)).
+			Commit()
+		if err == rpctypes.ErrLeaseNotFound {
+			l.dropLease(ttl, leaseID)
+			continue
+		} else if err != nil {
+			return 0, 0, ErrRateLimitInvalidTxn
+		}
+		if txnResp.Succeeded {
+			return granted, 0, nil
+		}
+
+		// taken by another instance : retry with the current bucket
+		kvs = txnResp.Responses[0].GetResponseRange().Kvs
+	}
+
+	// contended : retry after one token
+	return 0, time.Duration(float64(time.Second) / rate), nil
+}
+
+// lease lease of the key ttl, the key expires at least ttl after the put
+func (l *ClusterRateLimiter) lease(ctx context.Context, ttl int64) (clientv3.LeaseID, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	if lease, ok := l.leaseMap[ttl]; ok && lease.expireAt.Sub(now) >= time.Duration(ttl)*time.Second {
+		return lease.id, nil
+	}
+	leaseResp, err := l.ETCDClient.Grant(ctx, 2*ttl)
+	if err != nil {
+		return clientv3.NoLease, ErrRateLimitInvalidLease
+	}
+	l.leaseMap[ttl] = &clusterRateLimitLease{
+		id:       leaseResp.ID,
+		expireAt: now.Add(time.Duration(2*ttl) * time.Second),
+	}
+	return leaseResp.ID, nil
+}
+
+// dropLease forget the expired lease
+func (l *ClusterRateLimiter) dropLease(ttl int64, leaseID clientv3.LeaseID) {
+	l.mutex.Lock()
+	if lease, ok := l.leaseMap[ttl]; ok && lease.id == leaseID {
+		delete(l.leaseMap, ttl)
+	}
+	l.mutex.Unlock()
+}
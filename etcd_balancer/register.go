@@ -3,9 +3,13 @@ package balancer
 import (
 	"context"
 	"errors"
+	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/coreos/etcd/mvcc/mvccpb"
 	"github.com/sirupsen/logrus"
 )
 
@@ -18,6 +22,30 @@ var (
 	serverConfig *ServerConfig // server config
 )
 
+// register config
+const (
+	defaultRegisterRetryMinInterval = 500 * time.Millisecond // re-grant backoff min interval
+	defaultRegisterRevokeTimeout    = 3 * time.Second        // revoke lease timeout
+)
+
+// register status
+const (
+	RegistrarStatusRegistering RegistrarStatus = iota // granting lease & put key
+	RegistrarStatusRegistered                         // lease keep alive
+	RegistrarStatusStopped                            // stopped & lease revoked
+)
+
+// err
+var (
+	errRegisterLeaseLost = errors.New("[E] register lease keep alive lost")
+	ErrRegistrarNotFound = errors.New("[E] server is not registered")
+)
+
+// registrar list : server addr => registrar
+var (
+	registrarMap sync.Map
+)
+
 // SetServerConfig server config
 func SetServerConfig(cfg *ServerConfig) {
 	serverConfig = cfg
@@ -35,61 +63,303 @@ func getServerETCDKey(cfg *ServerConfig, serverAddr string) string {
 
 // RegisterServer register service with name as prefix to etcd
 func RegisterServer(serverAddr string) error {
+	_, err := StartRegistrar(serverAddr)
+	return err
+}
 
-	ticker := time.NewTicker(time.Duration(serverConfig.ETCDAliveTTL) * time.Second)
-
-	go func() {
-		for {
-			// key exist
-			getResp, err := etcdClient.Get(context.Background(), getServerETCDKey(serverConfig, serverAddr))
-			if err != nil {
-				logrus.Printf("[E] etcdClient.Get error : " + err.Error())
-			} else if getResp.Count == 0 {
-				// register server and keep alive
-				if err = registerServerAndKeepAlive(serverAddr); err != nil {
-					logrus.Error("registerServerAndKeepAlive error : " + err.Error())
-				}
-			} else {
-				// do nothing
-			}
+// StartRegistrar register service with name as prefix to etcd, the registrar
+// keeps the lease alive until Stop
+func StartRegistrar(serverAddr string) (*Registrar, error) {
+	r := newRegistrar(serverAddr)
+
+	// one registrar per server addr
+	if v, loaded := registrarMap.LoadOrStore(serverAddr, r); loaded {
+		return v.(*Registrar), nil
+	}
+
+	go r.run()
+	return r, nil
+}
+
+// UnRegisterServer remove server from etcd
+func UnRegisterServer(serverAddr string) {
+	if v, ok := registrarMap.Load(serverAddr); ok {
+		v.(*Registrar).Stop()
+		return
+	}
+	etcdClient.Delete(context.Background(), getServerETCDKey(serverConfig, serverAddr))
+}
+
+// CountRegisteredServers registered server instances
+func CountRegisteredServers(ctx context.Context) (int64, error) {
+	getResp, err := etcdClient.Get(ctx, getServerETCDPrefix(serverConfig), clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return 0, err
+	}
+	return getResp.Count, nil
+}
+
+// SetServerServing remove the server key while not serving, put it back while serving
+func SetServerServing(serverAddr string, serving bool) error {
+	v, ok := registrarMap.Load(serverAddr)
+	if !ok {
+		return ErrRegistrarNotFound
+	}
+	return v.(*Registrar).SetServing(serving)
+}
+
+// GetServerConfig get config
+func GetServerConfig() *ServerConfig {
+	return serverConfig
+}
+
+// RegistrarStatus register status
+type RegistrarStatus int32
+
+// String status name
+func (s RegistrarStatus) String() string {
+	switch s {
+	case RegistrarStatusRegistering:
+		return "registering"
+	case RegistrarStatusRegistered:
+		return "registered"
+	case RegistrarStatusStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// Registrar keep one lease alive for the server key
+//
+// the keep alive channel is drained, lease loss is detected immediately and
+// the lease is re-granted with jittered backoff
+type Registrar struct {
+	ETCDClient *clientv3.Client // etcd client
+	ServerAddr string           // server addr
+	ServerKey  string           // etcd key
+	AliveTTL   int64            // etcd ttl(second)
+
+	mutex      sync.Mutex
+	status     RegistrarStatus
+	leaseID    clientv3.LeaseID
+	notServing bool // the server key is removed, the lease is kept alive
+	ctx        context.Context
+	cancelFn   context.CancelFunc
+	doneChan   chan struct{}
+	stopOnce   sync.Once
+}
+
+// newRegistrar new registrar, started by StartRegistrar
+func newRegistrar(serverAddr string) *Registrar {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	return &Registrar{
+		ETCDClient: etcdClient,
+		ServerAddr: serverAddr,
+		ServerKey:  getServerETCDKey(serverConfig, serverAddr),
+		AliveTTL:   serverConfig.ETCDAliveTTL,
+		ctx:        ctx,
+		cancelFn:   cancelFn,
+		doneChan:   make(chan struct{}),
+	}
+}
+
+// Status register status
+func (r *Registrar) Status() RegistrarStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.status
+}
+
+// Done closed after the registrar stopped
+func (r *Registrar) Done() <-chan struct{} {
+	return r.doneChan
+}
+
+// IsServing the server key is registered while serving
+func (r *Registrar) IsServing() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return !r.notServing
+}
+
+// SetServing remove the server key while not serving, e.g. overloaded; the
+// lease is kept alive and the key is put back while serving
+func (r *Registrar) SetServing(serving bool) error {
+	r.mutex.Lock()
+	changed := r.notServing == serving
+	r.notServing = !serving
+	leaseID := r.leaseID
+	r.mutex.Unlock()
 
-			<-ticker.C
+	if !changed || leaseID == clientv3.NoLease {
+		return nil
+	}
+	ctx, cancelFn := context.WithTimeout(r.ctx, defaultRegisterRevokeTimeout)
+	defer cancelFn()
+
+	if !serving {
+		logrus.Printf("[info] etcd key not serving : %v\n", r.ServerKey)
+		if _, err := r.ETCDClient.Delete(ctx, r.ServerKey); err != nil {
+			return errors.New("[E] etcdClient.Delete error : " + err.Error())
 		}
-	}()
+		return nil
+	}
+	logrus.Printf("[info] etcd key serving : %v\n", r.ServerKey)
+	if _, err := r.ETCDClient.Put(ctx, r.ServerKey, r.ServerAddr, clientv3.WithLease(leaseID)); err != nil {
+		return errors.New("[E] etcdClient.Put error : " + err.Error())
+	}
 	return nil
 }
 
-// registerServerAndKeepAlive register server and keep alive
-func registerServerAndKeepAlive(serverAddr string) error {
+// Stop stop keep alive and revoke the lease
+func (r *Registrar) Stop() {
+	r.stopOnce.Do(func() {
+		r.cancelFn()
+		<-r.doneChan
+
+		// revoke lease : the server key is removed with it
+		r.revokeLease()
+		r.setStatus(RegistrarStatusStopped)
+
+		registrarMap.Delete(r.ServerAddr)
+	})
+}
+
+// run register & re-grant until stop
+func (r *Registrar) run() {
+	defer close(r.doneChan)
+
+	var retry uint
+	for {
+		err := r.registerAndKeepAlive(func() { retry = 0 })
+		if r.ctx.Err() != nil {
+			return
+		}
+		logrus.Errorf("registerAndKeepAlive error : %v", err)
+
+		// backoff
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(r.backoff(retry)):
+		}
+		retry++
+	}
+}
+
+// backoff re-grant interval : min * 2^retry, max ttl, jitter [0.5, 1.5)
+func (r *Registrar) backoff(retry uint) time.Duration {
+	maxInterval := time.Duration(r.AliveTTL) * time.Second
+	interval := defaultRegisterRetryMinInterval
+	for i := uint(0); i < retry && interval < maxInterval; i++ {
+		interval *= 2
+	}
+	if interval > maxInterval {
+		interval = maxInterval
+	}
+	return time.Duration(float64(interval) * (0.5 + rand.Float64()))
+}
+
+// registerAndKeepAlive register server and keep alive until the lease is lost
+//
+// the keep alive is bound to this attempt and the lease is revoked on return,
+// an abandoned lease is not kept alive
+func (r *Registrar) registerAndKeepAlive(onRegistered func()) error {
+	r.setStatus(RegistrarStatusRegistering)
+
+	ctx, cancelFn := context.WithCancel(r.ctx)
+	defer cancelFn()
+
 	// lease TTL is ttl-second
-	leaseResp, err := etcdClient.Grant(context.Background(), serverConfig.ETCDAliveTTL)
+	leaseResp, err := r.ETCDClient.Grant(ctx, r.AliveTTL)
 	if err != nil {
 		return errors.New("[E] etcdClient.Grant error : " + err.Error())
 	}
+	r.setLeaseID(leaseResp.ID)
+	defer func() {
+		cancelFn()
+		r.revokeLease()
+	}()
 
-	// etcd key
-	etcdKey := getServerETCDKey(serverConfig, serverAddr)
-	logrus.Printf("[info] etcd key : %v\n", etcdKey)
-
-	// save to etcd
-	_, err = etcdClient.Put(context.Background(), etcdKey, serverAddr, clientv3.WithLease(leaseResp.ID))
-	if err != nil {
-		return errors.New("[E] etcdClient.Put error : " + err.Error())
+	// save to etcd, not while not serving
+	watchRev := leaseResp.Revision
+	if r.IsServing() {
+		logrus.Printf("[info] etcd key : %v\n", r.ServerKey)
+		putResp, err := r.ETCDClient.Put(ctx, r.ServerKey, r.ServerAddr, clientv3.WithLease(leaseResp.ID))
+		if err != nil {
+			return errors.New("[E] etcdClient.Put error : " + err.Error())
+		}
+		watchRev = putResp.Header.Revision
 	}
 
 	// keep alive
-	if _, err = etcdClient.KeepAlive(context.Background(), leaseResp.ID); err != nil {
+	keepAliveChan, err := r.ETCDClient.KeepAlive(ctx, leaseResp.ID)
+	if err != nil {
 		return errors.New("[E] etcdClient.KeepAlive error : " + err.Error())
 	}
-	return nil
+	r.setStatus(RegistrarStatusRegistered)
+	onRegistered()
+
+	// watch server key : put back if it is deleted while serving
+	watchChan := r.ETCDClient.Watch(ctx, r.ServerKey, clientv3.WithRev(watchRev+1))
+
+	for {
+		select {
+		case resp, ok := <-keepAliveChan:
+			// channel closed : lease lost or stopped
+			if !ok || resp == nil {
+				return errRegisterLeaseLost
+			}
+
+		case watchResp, ok := <-watchChan:
+			if !ok {
+				watchChan = nil
+				continue
+			}
+			for _, ev := range watchResp.Events {
+				if ev.Type != mvccpb.DELETE || !r.IsServing() {
+					continue
+				}
+				if _, err := r.ETCDClient.Put(ctx, r.ServerKey, r.ServerAddr, clientv3.WithLease(leaseResp.ID)); err != nil {
+					return errors.New("[E] etcdClient.Put error : " + err.Error())
+				}
+			}
+		}
+	}
 }
 
-// UnRegisterServer remove server from etcd
-func UnRegisterServer(serverAddr string) {
-	etcdClient.Delete(context.Background(), getServerETCDKey(serverConfig, serverAddr))
+// revokeLease revoke the granted lease, not leaked when the register attempt ends
+func (r *Registrar) revokeLease() {
+	leaseID := r.getLeaseID()
+	if leaseID == clientv3.NoLease {
+		return
+	}
+	ctx, cancelFn := context.WithTimeout(context.Background(), defaultRegisterRevokeTimeout)
+	defer cancelFn()
+	// the lease may be expired already
+	if _, err := r.ETCDClient.Revoke(ctx, leaseID); err != nil && err != rpctypes.ErrLeaseNotFound {
+		logrus.Errorf("[E] etcdClient.Revoke error : %v", err)
+	}
+	r.setLeaseID(clientv3.NoLease)
 }
 
-// GetServerConfig get config
-func GetServerConfig() *ServerConfig {
-	return serverConfig
+// setStatus set status
+func (r *Registrar) setStatus(status RegistrarStatus) {
+	r.mutex.Lock()
+	r.status = status
+	r.mutex.Unlock()
+}
+
+// getLeaseID lease id
+func (r *Registrar) getLeaseID() clientv3.LeaseID {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.leaseID
+}
+
+// setLeaseID set lease id
+func (r *Registrar) setLeaseID(leaseID clientv3.LeaseID) {
+	r.mutex.Lock()
+	r.leaseID = leaseID
+	r.mutex.Unlock()
 }
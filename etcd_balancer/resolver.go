@@ -2,94 +2,165 @@ package balancer
 
 import (
 	"context"
+	"errors"
+	"time"
+
 	"github.com/coreos/etcd/clientv3"
 	"github.com/coreos/etcd/mvcc/mvccpb"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc/resolver"
 )
 
+// err
+var errResolverWatchClosed = errors.New("[E] etcd resolver watch channel closed")
+
+// resolver config
+const (
+	defaultResolverRetryInterval = 500 * time.Millisecond // re-get & re-watch interval after error
+)
+
 // NewResolver initialize an etcd client
 func NewResolver() resolver.Builder {
-	return new(etcdResolver)
+	return new(etcdResolverBuilder)
 }
 
-// etcdResolver etcd resolver
-type etcdResolver struct {
-	cc resolver.ClientConn
-}
+// etcdResolverBuilder etcd resolver builder
+type etcdResolverBuilder struct{}
 
 // Build creates a new resolver for the given target.
 //
 // gRPC dial calls Build synchronously, and fails if the returned error is
 // not nil.
-func (r *etcdResolver) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOption) (resolver.Resolver, error) {
+func (b *etcdResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	ctx, cancelFn := context.WithCancel(context.Background())
 
-	r.cc = cc
+	// one resolver per target
+	r := &etcdResolver{
+		cc:       cc,
+		cancelFn: cancelFn,
+	}
 
-	go r.watch("/" + target.Scheme + "/" + target.Endpoint + "/")
+	go r.watch(ctx, "/"+target.Scheme+"/"+target.Endpoint+"/")
 
 	return r, nil
 }
 
 // Scheme returns the scheme supported by this resolver.
 // Scheme is defined at https://github.com/grpc/grpc/blob/master/doc/naming.md.
-func (r etcdResolver) Scheme() string {
+func (b *etcdResolverBuilder) Scheme() string {
 	return serverConfig.SchemaName
 }
 
+// etcdResolver etcd resolver
+type etcdResolver struct {
+	cc       resolver.ClientConn
+	cancelFn context.CancelFunc // stop watch
+}
+
 // ResolveNow will be called by gRPC to try to resolve the target name
 // again. It's just a hint, resolver can ignore this if it's not necessary.
 //
 // It could be called multiple times concurrently.
-func (r etcdResolver) ResolveNow(rn resolver.ResolveNowOption) {
+func (r *etcdResolver) ResolveNow(rn resolver.ResolveNowOptions) {
 	// resolve
 }
 
 // Close closes the resolver.
-func (r etcdResolver) Close() {
-	// close
+func (r *etcdResolver) Close() {
+	// stop watch
+	r.cancelFn()
+}
+
+// watch watch server key prefix
+//
+// the server list is re-got and re-watched from the new revision after the
+// watch error, e.g. the revision is compacted or the watch channel is closed
+func (r *etcdResolver) watch(ctx context.Context, keyPrefix string) {
+	for {
+		if err := r.getAndWatch(ctx, keyPrefix); err != nil {
+			logrus.Errorf("[E] etcd resolver watch %s error : %v", keyPrefix, err)
+		}
+
+		// stopped
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(defaultResolverRetryInterval):
+		}
+	}
 }
 
-func (r *etcdResolver) watch(keyPrefix string) {
-	// server addr
-	var addrList []resolver.Address
+// getAndWatch get the server list and watch after the get revision,
+// return when the watch is broken
+//
+// etcd delete events carry no value, so the server addr is tracked by etcd key
+func (r *etcdResolver) getAndWatch(ctx context.Context, keyPrefix string) error {
+	// server addr : etcd key => addr
+	var addrMap = make(map[string]string)
 
 	// etcd key value
-	getResp, err := etcdClient.Get(context.Background(), keyPrefix, clientv3.WithPrefix())
+	getResp, err := etcdClient.Get(ctx, keyPrefix, clientv3.WithPrefix())
 	if err != nil {
-		logrus.Errorf("[E] etcdClient.Get error : " + err.Error())
-	} else {
-		for i := range getResp.Kvs {
-			addrList = append(addrList, resolver.Address{Addr: string(getResp.Kvs[i].Value)})
-		}
+		return err
+	}
+	for i := range getResp.Kvs {
+		addrMap[string(getResp.Kvs[i].Key)] = string(getResp.Kvs[i].Value)
 	}
 
 	//r.cc.NewAddress(addrList)
-	r.cc.UpdateState(resolver.State{Addresses: addrList})
+	r.cc.UpdateState(resolver.State{Addresses: getResolverAddrList(addrMap)})
 
-	// watch
-	rch := etcdClient.Watch(context.Background(), keyPrefix, clientv3.WithPrefix())
+	// watch after the get revision
+	rch := etcdClient.Watch(ctx, keyPrefix, clientv3.WithPrefix(), clientv3.WithRev(getResp.Header.Revision+1))
 	for n := range rch {
+		// compacted, canceled ...
+		if err := n.Err(); err != nil {
+			return err
+		}
+
 		// etcd events
+		var isChanged bool
 		for _, ev := range n.Events {
 			//logrus.Printf("%s %q : %q\n", ev.Type, ev.Kv.Key, ev.Kv.Value)
 			switch ev.Type {
 			case mvccpb.PUT:
-				// put
-				if !existFromResolverAddr(addrList, string(ev.Kv.Value)) {
-					addrList = append(addrList, resolver.Address{Addr: string(ev.Kv.Value)})
-					r.cc.UpdateState(resolver.State{Addresses: addrList})
+				// put : new key or addr changed
+				if addr, ok := addrMap[string(ev.Kv.Key)]; !ok || addr != string(ev.Kv.Value) {
+					addrMap[string(ev.Kv.Key)] = string(ev.Kv.Value)
+					isChanged = true
 				}
 
 			case mvccpb.DELETE:
-				// delete
-				if s, ok := removeFromResolverAddr(addrList, string(ev.Kv.Value)); ok {
-					addrList = s
-					r.cc.UpdateState(resolver.State{Addresses: addrList})
+				// delete : deleted or lease expired
+				if _, ok := addrMap[string(ev.Kv.Key)]; ok {
+					delete(addrMap, string(ev.Kv.Key))
+					isChanged = true
 				}
 			}
 		}
+
+		// update
+		if isChanged {
+			r.cc.UpdateState(resolver.State{Addresses: getResolverAddrList(addrMap)})
+		}
+	}
+
+	// closed
+	if err := ctx.Err(); err != nil {
+		return nil
+	}
+	return errResolverWatchClosed
+}
+
+// getResolverAddrList server addr list
+func getResolverAddrList(addrMap map[string]string) []resolver.Address {
+	var addrList = make([]resolver.Address, 0, len(addrMap))
+	for _, addr := range addrMap {
+		if !existFromResolverAddr(addrList, addr) {
+			addrList = append(addrList, resolver.Address{Addr: addr})
+		}
 	}
+	return addrList
 }
 
 // existFromResolverAddr check server addr
@@ -101,14 +172,3 @@ func existFromResolverAddr(l []resolver.Address, addr string) bool {
 	}
 	return false
 }
-
-// removeFromResolverAddr remove server addr
-func removeFromResolverAddr(s []resolver.Address, addr string) ([]resolver.Address, bool) {
-	for i := range s {
-		if s[i].Addr == addr {
-			s[i] = s[len(s)-1]
-			return s[:len(s)-1], true
-		}
-	}
-	return nil, false
-}
@@ -0,0 +1,158 @@
+//go:build integration
+// +build integration
+
+package balancer
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/rs/xid"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// TestResolver register, expire and re-register server
+func TestResolver(t *testing.T) {
+	var (
+		schema     = serverConfig.SchemaName
+		serverName = "resolver_test_" + xid.New().String()
+		keyPrefix  = "/" + schema + "/" + serverName + "/"
+		ctx        = context.Background()
+	)
+
+	// resolver
+	cc := &testClientConn{t: t, stateChan: make(chan resolver.State, 16)}
+	r, err := NewResolver().Build(resolver.Target{Scheme: schema, Endpoint: serverName}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("resolver.Build error : %v", err)
+	}
+	defer r.Close()
+	cc.expect()
+
+	// register : addr1 without keep alive, addr2 with keep alive
+	expireLease, err := etcdClient.Grant(ctx, 2)
+	if err != nil {
+		t.Fatalf("etcdClient.Grant error : %v", err)
+	}
+	aliveLease, err := etcdClient.Grant(ctx, 2)
+	if err != nil {
+		t.Fatalf("etcdClient.Grant error : %v", err)
+	}
+	defer etcdClient.Revoke(ctx, aliveLease.ID)
+	if _, err := etcdClient.KeepAlive(ctx, aliveLease.ID); err != nil {
+		t.Fatalf("etcdClient.KeepAlive error : %v", err)
+	}
+	testPut(t, keyPrefix+"addr1", "127.0.0.1:50001", expireLease.ID)
+	testPut(t, keyPrefix+"addr2", "127.0.0.1:50002", aliveLease.ID)
+	cc.expect("127.0.0.1:50001", "127.0.0.1:50002")
+
+	// expire
+	cc.expect("127.0.0.1:50002")
+
+	// re-register
+	testPut(t, keyPrefix+"addr1", "127.0.0.1:50001", aliveLease.ID)
+	cc.expect("127.0.0.1:50001", "127.0.0.1:50002")
+
+	// put : addr changed
+	testPut(t, keyPrefix+"addr2", "127.0.0.1:50003", aliveLease.ID)
+	cc.expect("127.0.0.1:50001", "127.0.0.1:50003")
+
+	// delete
+	if _, err := etcdClient.Delete(ctx, keyPrefix+"addr2"); err != nil {
+		t.Fatalf("etcdClient.Delete error : %v", err)
+	}
+	cc.expect("127.0.0.1:50001")
+}
+
+// TestResolverTargets each target has its own resolver
+func TestResolverTargets(t *testing.T) {
+	var (
+		schema  = serverConfig.SchemaName
+		builder = NewResolver()
+		ctx     = context.Background()
+	)
+
+	var ccList []*testClientConn
+	for _, addr := range []string{"127.0.0.1:50011", "127.0.0.1:50012"} {
+		serverName := "resolver_test_" + xid.New().String()
+		testPut(t, "/"+schema+"/"+serverName+"/"+addr, addr, clientv3.NoLease)
+		defer etcdClient.Delete(ctx, "/"+schema+"/"+serverName+"/", clientv3.WithPrefix())
+
+		cc := &testClientConn{t: t, stateChan: make(chan resolver.State, 16)}
+		r, err := builder.Build(resolver.Target{Scheme: schema, Endpoint: serverName}, cc, resolver.BuildOptions{})
+		if err != nil {
+			t.Fatalf("resolver.Build error : %v", err)
+		}
+		defer r.Close()
+		ccList = append(ccList, cc)
+	}
+	ccList[0].expect("127.0.0.1:50011")
+	ccList[1].expect("127.0.0.1:50012")
+}
+
+// testPut put server key
+func testPut(t *testing.T, key, addr string, leaseID clientv3.LeaseID) {
+	if _, err := etcdClient.Put(context.Background(), key, addr, clientv3.WithLease(leaseID)); err != nil {
+		t.Fatalf("etcdClient.Put error : %v", err)
+	}
+}
+
+// testClientConn resolver.ClientConn
+type testClientConn struct {
+	t         *testing.T
+	stateChan chan resolver.State
+}
+
+// UpdateState updates the state of the ClientConn appropriately.
+func (c *testClientConn) UpdateState(s resolver.State) {
+	c.stateChan <- s
+}
+
+// NewAddress deprecated
+func (c *testClientConn) NewAddress(addresses []resolver.Address) {
+	c.UpdateState(resolver.State{Addresses: addresses})
+}
+
+// NewServiceConfig deprecated
+func (c *testClientConn) NewServiceConfig(serviceConfig string) {}
+
+// ReportError notifies the ClientConn that the Resolver encountered an error.
+func (c *testClientConn) ReportError(err error) {
+	c.t.Logf("resolver error : %v", err)
+}
+
+// ParseServiceConfig parses the provided service config.
+func (c *testClientConn) ParseServiceConfig(serviceConfigJSON string) *serviceconfig.ParseResult {
+	return &serviceconfig.ParseResult{}
+}
+
+// expect wait for the address list
+func (c *testClientConn) expect(addrList ...string) {
+	c.t.Helper()
+	sort.Strings(addrList)
+	want := strings.Join(addrList, ",")
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case s := <-c.stateChan:
+			var got []string
+			for i := range s.Addresses {
+				got = append(got, s.Addresses[i].Addr)
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") == want {
+				return
+			}
+			c.t.Logf("resolver state : %v", got)
+
+		case <-timeout:
+			c.t.Fatalf("wait for resolver state timeout : %s", want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"github.com/coreos/etcd/clientv3"
+	"strings"
+)
+
+// NewRWLock new read write lock
+func NewRWLock(lockKey string) *RWLock {
+	return &RWLock{LockKey: lockKey}
+}
+
+// rw lock key
+const (
+	rwLockReadKey  = "read"  // lockKey\x00read/leaseId
+	rwLockWriteKey = "write" // lockKey\x00write/leaseId
+)
+
+// RWLock distributed read write lock
+//
+// readers wait for the write keys created before them, writers wait for all
+// keys created before them. a waiting writer is not starved : the readers
+// coming after it wait for it.
+//
+// every RLock / Lock returns its own held lock, unlock it with its UnLock; the
+// RWLock can be shared by goroutines.
+type RWLock struct {
+	ETCDClient *clientv3.Client // etcd client
+	LockKey    string           // lock key prefix
+	LockKeyTTL int64            // lock key etcd ttl
+}
+
+// RLock get shared lock, blocks until the writers before it unlock or ctx is done
+func (l *RWLock) RLock(ctx context.Context) (*DistributedLock, error) {
+	return l.waitLock(ctx, rwLockReadKey, lockWaitPrefix(l.LockKey)+rwLockWriteKey+"/")
+}
+
+// Lock get exclusive lock, blocks until the readers and writers before it
+// unlock or ctx is done
+func (l *RWLock) Lock(ctx context.Context) (*DistributedLock, error) {
+	return l.waitLock(ctx, rwLockWriteKey, lockWaitPrefix(l.LockKey))
+}
+
+// waitLock put lockKey\x00kind/leaseId and wait for the keys under the wait prefix
+func (l *RWLock) waitLock(ctx context.Context, kind, waitPrefix string) (*DistributedLock, error) {
+	if strings.Contains(l.LockKey, lockKeySeparator) {
+		return nil, ErrLockInvalidKey
+	}
+	d := &DistributedLock{
+		ETCDClient: l.ETCDClient,
+		LockKeyTTL: l.LockKeyTTL,
+		LockKey:    l.LockKey,
+	}
+
+	// lease
+	if err := d.grantAndKeepAlive(); err != nil {
+		return nil, err
+	}
+
+	// put waiter key
+	isOwner, err := d.enqueueKey(fmt.Sprintf("%s%s/%x", lockWaitPrefix(l.LockKey), kind, d.LockLeaseId), waitPrefix)
+	if err != nil {
+		d.UnLock()
+		return nil, err
+	}
+
+	// wait
+	if !isOwner {
+		if err := d.waitPredecessor(ctx, waitPrefix); err != nil {
+			d.UnLock()
+			return nil, err
+		}
+	}
+	return d, nil
+}
@@ -0,0 +1,311 @@
+package balancer
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/rs/xid"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// saga config
+const (
+	sagaKeyPrefix             = "saga/"                // etcd key prefix : saga/{id}
+	sagaLockKeyPrefix         = "saga_lock/"           // distributed lock key prefix : saga_lock/{id}
+	sagaMetadataKey           = "x-saga-id"            // grpc metadata key
+	defaultSagaStepRetryTimes = 3                      // step retry times
+	defaultSagaRetryMinDelay  = 100 * time.Millisecond // retry backoff min interval
+	defaultSagaRetryMaxDelay  = 3 * time.Second        // retry backoff max interval
+
+	defaultSagaRecordRetention int64 = 24 * 60 * 60 // done record etcd ttl(24h)
+)
+
+// saga status
+const (
+	SagaStatusRunning      = "running"      // running steps
+	SagaStatusCompensating = "compensating" // a step failed, running compensations
+	SagaStatusCompleted    = "completed"    // all steps succeed
+	SagaStatusCompensated  = "compensated"  // all compensations succeed
+	SagaStatusFailed       = "failed"       // a compensation failed, need manual fix
+)
+
+// err
+var (
+	ErrSagaNotRegistered = status.Error(codes.NotFound, "saga is not registered")
+	ErrSagaInvalidRecord = status.Error(codes.Internal, "invalid saga record")
+	ErrSagaInvalidPut    = status.Error(codes.Internal, "ETCDClient.Put fail")
+	ErrSagaInvalidGet    = status.Error(codes.Internal, "ETCDClient.Get fail")
+	ErrSagaCompensated   = status.Error(codes.Aborted, "saga compensated")
+	ErrSagaFailed        = status.Error(codes.Internal, "saga compensation fail")
+	ErrSagaInvalidLease  = status.Error(codes.Internal, "ETCDClient.Grant lease fail")
+)
+
+// registered saga : name => *Saga
+var (
+	sagaMap sync.Map
+)
+
+// SagaStep saga step : a grpc call and its compensating call
+//
+// the ctx carries the saga id in grpc metadata, Action and Compensate must be
+// idempotent : they are retried and resumed after a restart.
+type SagaStep struct {
+	Name       string                                                      // step name
+	Action     func(ctx context.Context, sagaID string, data []byte) error // forward call
+	Compensate func(ctx context.Context, sagaID string, data []byte) error // compensating call
+	RetryTimes int                                                         // retry times with backoff
+}
+
+// Saga ordered steps, registered by name so pending sagas can be resumed
+type Saga struct {
+	Name  string      // saga name
+	Steps []*SagaStep // ordered steps
+}
+
+// SagaRecord saga progress : saga/{id}
+type SagaRecord struct {
+	SagaID         string `json:"saga_id"`         // saga id
+	Name           string `json:"name"`            // saga name
+	Data           []byte `json:"data"`            // saga data
+	Status         string `json:"status"`          // saga status
+	Step           int    `json:"step"`            // next step
+	CompensateStep int    `json:"compensate_step"` // next compensation
+	Error          string `json:"error,omitempty"` // failed step error
+	UpdatedAt      int64  `json:"updated_at"`      // unix nano
+}
+
+// isDone completed, compensated or failed
+func (r *SagaRecord) isDone() bool {
+	return r.Status == SagaStatusCompleted || r.Status == SagaStatusCompensated || r.Status == SagaStatusFailed
+}
+
+// RegisterSaga register saga
+func RegisterSaga(saga *Saga) {
+	sagaMap.Store(saga.Name, saga)
+}
+
+// SagaIDFromContext saga id in the incoming metadata
+func SagaIDFromContext(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if data := md.Get(sagaMetadataKey); len(data) > 0 {
+			return data[0]
+		}
+	}
+	return ""
+}
+
+// StartSaga persist and run the saga, returns ErrSagaCompensated if a step
+// failed and the compensations succeed
+func StartSaga(ctx context.Context, name string, data []byte) (sagaID string, err error) {
+	v, ok := sagaMap.Load(name)
+	if !ok {
+		return "", ErrSagaNotRegistered
+	}
+
+	// record
+	record := &SagaRecord{
+		SagaID:         xid.New().String(),
+		Name:           name,
+		Data:           data,
+		Status:         SagaStatusRunning,
+		CompensateStep: -1,
+	}
+
+	// run under the saga lock : resumable by another instance after a crash
+	_, err = WithLock(ctx, sagaLockKeyPrefix+record.SagaID, &LockOptions{TryOnce: true}, func(ctx context.Context) error {
+		if err := putSagaRecord(ctx, record); err != nil {
+			return err
+		}
+		return v.(*Saga).run(ctx, record)
+	})
+	return record.SagaID, err
+}
+
+// ResumeSagas run the pending sagas of the registered names
+//
+// a saga running on another instance is skipped : it holds the saga lock.
+func ResumeSagas(ctx context.Context) error {
+	getResp, err := etcdClient.Get(ctx, sagaKeyPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return ErrSagaInvalidGet
+	}
+
+	for _, kv := range getResp.Kvs {
+		record := new(SagaRecord)
+		if err := json.Unmarshal(kv.Value, record); err != nil || record.isDone() {
+			continue
+		}
+		v, ok := sagaMap.Load(record.Name)
+		if !ok {
+			continue
+		}
+
+		_, err := WithLock(ctx, sagaLockKeyPrefix+record.SagaID, &LockOptions{TryOnce: true}, func(ctx context.Context) error {
+			// the record read before the lock may be stale : re-read under the lock
+			current, err := getSagaRecord(ctx, record.SagaID)
+			if err != nil || current == nil || current.isDone() {
+				return err
+			}
+			return v.(*Saga).run(ctx, current)
+		})
+		if err != nil && err != ErrLockIsLocking {
+			logrus.Errorf("ResumeSagas %s error : %v", record.SagaID, err)
+		}
+	}
+	return nil
+}
+
+// run run the steps from the record, then the compensations in reverse order
+func (s *Saga) run(ctx context.Context, record *SagaRecord) error {
+	ctx = metadata.AppendToOutgoingContext(ctx, sagaMetadataKey, record.SagaID)
+
+	// steps
+	for record.Status == SagaStatusRunning && record.Step < len(s.Steps) {
+		step := s.Steps[record.Step]
+		if err := retrySagaStep(ctx, step, step.Action, record); err != nil {
+			// compensate from the failed step : it may be partially done
+			logrus.Errorf("saga %s step %s error : %v", record.SagaID, step.Name, err)
+			record.Status, record.CompensateStep, record.Error = SagaStatusCompensating, record.Step, err.Error()
+		} else {
+			record.Step++
+		}
+		if err := putSagaRecord(ctx, record); err != nil {
+			return err
+		}
+	}
+	if record.Status == SagaStatusRunning {
+		record.Status = SagaStatusCompleted
+		return putSagaRecord(ctx, record)
+	}
+
+	// compensations
+	for record.Status == SagaStatusCompensating && record.CompensateStep >= 0 {
+		step := s.Steps[record.CompensateStep]
+		if step.Compensate != nil {
+			if err := retrySagaStep(ctx, step, step.Compensate, record); err != nil {
+				logrus.Errorf("saga %s compensate %s error : %v", record.SagaID, step.Name, err)
+				record.Status, record.Error = SagaStatusFailed, err.Error()
+				if err := putSagaRecord(ctx, record); err != nil {
+					return err
+				}
+				return ErrSagaFailed
+			}
+		}
+		record.CompensateStep--
+		if err := putSagaRecord(ctx, record); err != nil {
+			return err
+		}
+	}
+	if record.Status == SagaStatusCompensating {
+		record.Status = SagaStatusCompensated
+		if err := putSagaRecord(ctx, record); err != nil {
+			return err
+		}
+	}
+
+	switch record.Status {
+	case SagaStatusCompensated:
+		return ErrSagaCompensated
+	case SagaStatusFailed:
+		return ErrSagaFailed
+	}
+	return nil
+}
+
+// retrySagaStep call fn with backoff until success or retry times
+func retrySagaStep(ctx context.Context, step *SagaStep, fn func(ctx context.Context, sagaID string, data []byte) error, record *SagaRecord) (err error) {
+	retryTimes := step.RetryTimes
+	if retryTimes <= 0 {
+		retryTimes = defaultSagaStepRetryTimes
+	}
+
+	interval := defaultSagaRetryMinDelay
+	for i := 0; i <= retryTimes; i++ {
+		if err = fn(ctx, record.SagaID, record.Data); err == nil {
+			return nil
+		}
+		if i == retryTimes {
+			break
+		}
+
+		// backoff
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(interval):
+		}
+		if interval *= 2; interval > defaultSagaRetryMaxDelay {
+			interval = defaultSagaRetryMaxDelay
+		}
+	}
+	return err
+}
+
+// getSagaRecord saga record, nil if expired
+func getSagaRecord(ctx context.Context, sagaID string) (*SagaRecord, error) {
+	getResp, err := etcdClient.Get(ctx, sagaKeyPrefix+sagaID)
+	if err != nil {
+		return nil, ErrSagaInvalidGet
+	} else if getResp.Count == 0 {
+		return nil, nil
+	}
+	record := new(SagaRecord)
+	if err := json.Unmarshal(getResp.Kvs[0].Value, record); err != nil {
+		return nil, ErrSagaInvalidRecord
+	}
+	return record, nil
+}
+
+// putSagaRecord save saga progress, the done record expires after retention
+//
+// the put is fenced by the saga lock of ctx : an instance which lost the lock
+// does not overwrite the progress of the new owner
+func putSagaRecord(ctx context.Context, record *SagaRecord) error {
+	record.UpdatedAt = time.Now().UnixNano()
+	value, err := json.Marshal(record)
+	if err != nil {
+		return ErrSagaInvalidRecord
+	}
+
+	// retention
+	var (
+		opts    []clientv3.OpOption
+		leaseID = clientv3.NoLease
+	)
+	if record.isDone() {
+		leaseResp, err := etcdClient.Grant(ctx, defaultSagaRecordRetention)
+		if err != nil {
+			return ErrSagaInvalidLease
+		}
+		leaseID = leaseResp.ID
+		opts = append(opts, clientv3.WithLease(leaseID))
+	}
+
+	// lock owned
+	var cmps []clientv3.Cmp
+	if lock := LockFromContext(ctx); lock != nil {
+		cmps = lock.isOwnerCmp()
+	}
+	txnResp, err := etcdClient.Txn(ctx).
+		If(cmps...).
+		Then(clientv3.OpPut(sagaKeyPrefix+record.SagaID, string(value), opts...)).
+		Commit()
+	if err == nil && txnResp.Succeeded {
+		return nil
+	}
+	if leaseID != clientv3.NoLease {
+		revokeCtx, cancelFn := context.WithTimeout(context.Background(), defaultRegisterRevokeTimeout)
+		etcdClient.Revoke(revokeCtx, leaseID)
+		cancelFn()
+	}
+	if err != nil {
+		return ErrSagaInvalidPut
+	}
+	return ErrLockIsNotOwner
+}
@@ -0,0 +1,226 @@
+//go:build integration
+// +build integration
+
+package balancer
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rs/xid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	ecpb "google.golang.org/grpc/examples/features/proto/echo"
+	"google.golang.org/grpc/status"
+)
+
+// TestSagaCompleted run the steps in order
+func TestSagaCompleted(t *testing.T) {
+	calls := new(testSagaCallList)
+	name, stop := registerTestSaga(t, calls, "order", "stock")
+	defer stop()
+
+	sagaID, err := StartSaga(context.Background(), name, []byte("ok"))
+	if err != nil {
+		t.Fatalf("StartSaga error : %v", err)
+	}
+	calls.expect(t, sagaID, "order.reserve", "stock.reserve")
+}
+
+// TestSagaCompensated a failed step is retried, then the compensations run in
+// reverse order from the failed step
+func TestSagaCompensated(t *testing.T) {
+	calls := new(testSagaCallList)
+	name, stop := registerTestSaga(t, calls, "order", "stock", "payment")
+	defer stop()
+
+	sagaID, err := StartSaga(context.Background(), name, []byte("fail"))
+	if err != ErrSagaCompensated {
+		t.Fatalf("StartSaga want ErrSagaCompensated, got : %v", err)
+	}
+	calls.expect(t, sagaID,
+		"order.reserve", "stock.reserve",
+		"payment.reserve", "payment.reserve", "payment.reserve", "payment.reserve",
+		"payment.cancel", "stock.cancel", "order.cancel",
+	)
+	expectSagaStatus(t, sagaID, SagaStatusCompensated)
+}
+
+// TestSagaResumed a saga crashed after the first step is resumed from the second step
+func TestSagaResumed(t *testing.T) {
+	calls := new(testSagaCallList)
+	name, stop := registerTestSaga(t, calls, "order", "stock")
+	defer stop()
+
+	// crashed : order step done
+	record := &SagaRecord{
+		SagaID:         xid.New().String(),
+		Name:           name,
+		Data:           []byte("ok"),
+		Status:         SagaStatusRunning,
+		Step:           1,
+		CompensateStep: -1,
+	}
+	putTestSagaRecord(t, record)
+
+	if err := ResumeSagas(context.Background()); err != nil {
+		t.Fatalf("ResumeSagas error : %v", err)
+	}
+	calls.expect(t, record.SagaID, "stock.reserve")
+	expectSagaStatus(t, record.SagaID, SagaStatusCompleted)
+
+	// done : not run again
+	if err := ResumeSagas(context.Background()); err != nil {
+		t.Fatalf("ResumeSagas error : %v", err)
+	}
+	calls.expect(t, record.SagaID)
+}
+
+// TestSagaResumedCompensating a saga crashed while compensating continues the compensations
+func TestSagaResumedCompensating(t *testing.T) {
+	calls := new(testSagaCallList)
+	name, stop := registerTestSaga(t, calls, "order", "stock", "payment")
+	defer stop()
+
+	// crashed : payment & stock compensated
+	record := &SagaRecord{
+		SagaID:         xid.New().String(),
+		Name:           name,
+		Data:           []byte("fail"),
+		Status:         SagaStatusCompensating,
+		Step:           2,
+		CompensateStep: 0,
+	}
+	putTestSagaRecord(t, record)
+
+	if err := ResumeSagas(context.Background()); err != nil {
+		t.Fatalf("ResumeSagas error : %v", err)
+	}
+	calls.expect(t, record.SagaID, "order.cancel")
+	expectSagaStatus(t, record.SagaID, SagaStatusCompensated)
+}
+
+// registerTestSaga register saga of the steps, every step calls its in-process
+// echo server; stop closes the servers
+func registerTestSaga(t *testing.T, calls *testSagaCallList, stepNames ...string) (name string, stop func()) {
+	saga := &Saga{Name: "saga_test_" + xid.New().String()}
+	var stopFns []func()
+	for _, stepName := range stepNames {
+		conn, stopServer := startTestSagaServer(t, stepName, calls)
+		stopFns = append(stopFns, stopServer)
+
+		client := ecpb.NewEchoClient(conn)
+		call := func(action string) func(ctx context.Context, sagaID string, data []byte) error {
+			return func(ctx context.Context, sagaID string, data []byte) error {
+				_, err := client.UnaryEcho(ctx, &ecpb.EchoRequest{Message: action + ":" + string(data)})
+				return err
+			}
+		}
+		saga.Steps = append(saga.Steps, &SagaStep{
+			Name:       stepName,
+			Action:     call("reserve"),
+			Compensate: call("cancel"),
+		})
+	}
+	RegisterSaga(saga)
+
+	return saga.Name, func() {
+		for _, stopFn := range stopFns {
+			stopFn()
+		}
+	}
+}
+
+// startTestSagaServer in-process echo server of the step
+func startTestSagaServer(t *testing.T, stepName string, calls *testSagaCallList) (*grpc.ClientConn, func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error : %v", err)
+	}
+	s := grpc.NewServer()
+	ecpb.RegisterEchoServer(s, &testSagaServer{name: stepName, calls: calls})
+	go s.Serve(lis)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		s.Stop()
+		t.Fatalf("grpc.Dial error : %v", err)
+	}
+	return conn, func() {
+		conn.Close()
+		s.Stop()
+	}
+}
+
+// testSagaServer echo server, the payment reserve of data "fail" fails
+type testSagaServer struct {
+	ecpb.UnimplementedEchoServer
+
+	name  string
+	calls *testSagaCallList
+}
+
+// UnaryEcho record the call and the saga id of the incoming metadata
+func (s *testSagaServer) UnaryEcho(ctx context.Context, req *ecpb.EchoRequest) (*ecpb.EchoResponse, error) {
+	action := strings.Split(req.Message, ":")[0]
+	s.calls.add(s.name+"."+action, SagaIDFromContext(ctx))
+	if s.name == "payment" && req.Message == "reserve:fail" {
+		return nil, status.Error(codes.FailedPrecondition, "payment fail")
+	}
+	return &ecpb.EchoResponse{Message: req.Message}, nil
+}
+
+// putTestSagaRecord put saga record
+func putTestSagaRecord(t *testing.T, record *SagaRecord) {
+	value, _ := json.Marshal(record)
+	if _, err := etcdClient.Put(context.Background(), sagaKeyPrefix+record.SagaID, string(value)); err != nil {
+		t.Fatalf("etcdClient.Put error : %v", err)
+	}
+}
+
+// expectSagaStatus check saga record status
+func expectSagaStatus(t *testing.T, sagaID, status string) {
+	t.Helper()
+	record, err := getSagaRecord(context.Background(), sagaID)
+	if err != nil || record == nil {
+		t.Fatalf("getSagaRecord error : %v", err)
+	}
+	if record.Status != status {
+		t.Fatalf("saga status : %s, want : %s", record.Status, status)
+	}
+}
+
+// testSagaCallList server calls
+type testSagaCallList struct {
+	mutex   sync.Mutex
+	calls   []string
+	sagaIDs []string // saga id seen by the server
+}
+
+// add add call
+func (l *testSagaCallList) add(call, sagaID string) {
+	l.mutex.Lock()
+	l.calls = append(l.calls, call)
+	l.sagaIDs = append(l.sagaIDs, sagaID)
+	l.mutex.Unlock()
+}
+
+// expect check and reset calls, every call carries the saga id
+func (l *testSagaCallList) expect(t *testing.T, sagaID string, calls ...string) {
+	t.Helper()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if strings.Join(l.calls, ",") != strings.Join(calls, ",") {
+		t.Fatalf("saga calls : %v, want : %v", l.calls, calls)
+	}
+	for i, id := range l.sagaIDs {
+		if id != sagaID {
+			t.Fatalf("saga call %s saga id : %q, want : %q", l.calls[i], id, sagaID)
+		}
+	}
+	l.calls, l.sagaIDs = nil, nil
+}
@@ -0,0 +1,118 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+)
+
+// NewSemaphore new semaphore, at most limit permits are held at once
+func NewSemaphore(name string, limit int64) *Semaphore {
+	return &Semaphore{
+		SemaphoreKey: "semaphore/" + name,
+		Limit:        limit,
+	}
+}
+
+// err
+var (
+	ErrSemaphoreInvalidLimit = status.Error(codes.InvalidArgument, "invalid semaphore limit")
+)
+
+// Semaphore distributed counting semaphore
+//
+// every permit is a key held by a lease like DistributedLock, a waiter holds a
+// permit when less than limit keys were created before it. the permit of a
+// crashed holder is reclaimed when its lease expires.
+//
+// every Acquire returns its own permit, release it with its UnLock; the
+// Semaphore can be shared by goroutines.
+type Semaphore struct {
+	ETCDClient   *clientv3.Client // etcd client
+	SemaphoreKey string           // etcd key prefix
+	Limit        int64            // max permits
+	LockKeyTTL   int64            // permit key etcd ttl
+}
+
+// Acquire get a permit, blocks until a permit is released or ctx is done
+func (s *Semaphore) Acquire(ctx context.Context) (*DistributedLock, error) {
+	if s.Limit <= 0 {
+		return nil, ErrSemaphoreInvalidLimit
+	}
+	if strings.Contains(s.SemaphoreKey, lockKeySeparator) {
+		return nil, ErrLockInvalidKey
+	}
+
+	d := &DistributedLock{
+		ETCDClient: s.ETCDClient,
+		LockKeyTTL: s.LockKeyTTL,
+		LockKey:    s.SemaphoreKey,
+	}
+
+	// lease
+	if err := d.grantAndKeepAlive(); err != nil {
+		return nil, err
+	}
+
+	// put permit key
+	waitPrefix := lockWaitPrefix(s.SemaphoreKey)
+	if _, err := d.enqueueKey(fmt.Sprintf("%s%x", waitPrefix, d.LockLeaseId), waitPrefix); err != nil {
+		d.UnLock()
+		return nil, err
+	}
+
+	// wait
+	if err := s.waitPermit(ctx, d, waitPrefix); err != nil {
+		d.UnLock()
+		return nil, err
+	}
+	return d, nil
+}
+
+// waitPermit wait until less than limit keys were created before the permit key
+//
+// the first limit keys by create revision hold the permits; a count with the
+// create revision filter is not used, etcd counts before filtering
+func (s *Semaphore) waitPermit(ctx context.Context, d *DistributedLock, waitPrefix string) error {
+	for {
+		// the first limit keys
+		getResp, err := d.ETCDClient.Get(ctx, waitPrefix,
+			clientv3.WithPrefix(), clientv3.WithKeysOnly(), clientv3.WithLimit(s.Limit),
+			clientv3.WithSort(clientv3.SortByCreateRevision, clientv3.SortAscend))
+		if err != nil {
+			return d.waitError(ctx, ErrLockInvalidGet)
+		}
+
+		// get permit
+		for _, kv := range getResp.Kvs {
+			if kv.CreateRevision >= d.LockRevision {
+				return nil
+			}
+		}
+
+		// wait any permit release
+		if err := s.waitRelease(ctx, d, waitPrefix, getResp.Header.Revision); err != nil {
+			return err
+		}
+	}
+}
+
+// waitRelease wait a key delete under the prefix after revision
+func (s *Semaphore) waitRelease(ctx context.Context, d *DistributedLock, waitPrefix string, revision int64) error {
+	watchCtx, watchCancelFn := context.WithCancel(ctx)
+	defer watchCancelFn()
+
+	watchChan := d.ETCDClient.Watch(watchCtx, waitPrefix, clientv3.WithPrefix(), clientv3.WithRev(revision+1))
+	for watchResp := range watchChan {
+		for _, ev := range watchResp.Events {
+			if ev.Type == mvccpb.DELETE {
+				return nil
+			}
+		}
+	}
+	return d.waitError(ctx, ErrLockIsLocking)
+}
@@ -0,0 +1,215 @@
+package balancer
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/sirupsen/logrus"
+)
+
+// tcc recovery config
+const (
+	tccRecoveryLockKey         = "try_confirm_cancel/recovery" // distributed lock key
+	defaultTCCRecoveryInterval = 10 * time.Second              // recovery interval
+)
+
+// StartTCCRecovery run RecoverTCCTransactions every interval until ctx is done
+func StartTCCRecovery(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultTCCRecoveryInterval
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := RecoverTCCTransactions(ctx); err != nil {
+				logrus.Errorf("RecoverTCCTransactions error : %v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// RecoverTCCTransactions finish the transactions of crashed coordinators and participants
+//
+// the records are read by one ranged get, the finished transactions are
+// skipped. the coordinator part runs on one instance under a DistributedLock :
+// a trying transaction whose coordinator is lost or deadline is passed is
+// cancelled, a decided one is completed when all branches are finished. the
+// participant part runs for every participant registered in this process,
+// under a DistributedLock per participant : the decided branches are confirmed
+// or cancelled. the participants not registered by RegisterTCCParticipant are
+// never recovered, their stale branches are logged by the coordinator part.
+func RecoverTCCTransactions(ctx context.Context) error {
+	// transactions in flight
+	transactionMap, err := scanTCCTransactions(ctx)
+	if err != nil {
+		return err
+	}
+	if len(transactionMap) == 0 {
+		return nil
+	}
+
+	// coordinator
+	_, err = WithLock(ctx, tccRecoveryLockKey, &LockOptions{TryOnce: true}, func(ctx context.Context) error {
+		for id, tx := range transactionMap {
+			if err := recoverTCCTransaction(ctx, id, tx); err != nil {
+				logrus.Errorf("recoverTCCTransaction %s error : %v", id, err)
+			}
+		}
+		return nil
+	})
+	if err != nil && err != ErrLockIsLocking {
+		return err
+	}
+
+	// participants
+	tccParticipantMap.Range(func(key, value interface{}) bool {
+		p := value.(*TCCParticipant)
+		_, err = WithLock(ctx, tccRecoveryLockKey+"/"+p.ParticipantID, &LockOptions{TryOnce: true}, func(ctx context.Context) error {
+			for id, tx := range transactionMap {
+				if err := p.recover(ctx, id, tx); err != nil {
+					logrus.Errorf("TCCParticipant.recover %s error : %v", id, err)
+				}
+			}
+			return nil
+		})
+		if err == ErrLockIsLocking {
+			err = nil
+		}
+		return err == nil
+	})
+	return err
+}
+
+// tccRecoveryTransaction transaction record & branches read by the recovery
+type tccRecoveryTransaction struct {
+	record   *TCCTransactionRecord
+	branches map[string]*TCCBranchRecord // branch key => record
+}
+
+// scanTCCTransactions the transactions not finished : transaction id => records
+func scanTCCTransactions(ctx context.Context) (map[string]*tccRecoveryTransaction, error) {
+	getResp, err := etcdClient.Get(ctx, tccTransactionKeyPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, ErrTCCInvalidGet
+	}
+
+	transactionMap := make(map[string]*tccRecoveryTransaction)
+	getTransaction := func(id string) *tccRecoveryTransaction {
+		tx, ok := transactionMap[id]
+		if !ok {
+			tx = &tccRecoveryTransaction{branches: make(map[string]*TCCBranchRecord)}
+			transactionMap[id] = tx
+		}
+		return tx
+	}
+	for _, kv := range getResp.Kvs {
+		id := strings.TrimPrefix(string(kv.Key), tccTransactionKeyPrefix)
+
+		// branch
+		if i := strings.Index(id, tccTransactionBranchKey); i >= 0 {
+			branch := new(TCCBranchRecord)
+			if err := json.Unmarshal(kv.Value, branch); err != nil {
+				logrus.Errorf("invalid tcc branch record %s : %v", kv.Key, err)
+				continue
+			}
+			getTransaction(id[:i]).branches[string(kv.Key)] = branch
+			continue
+		}
+
+		// transaction
+		record := new(TCCTransactionRecord)
+		if err := json.Unmarshal(kv.Value, record); err != nil {
+			logrus.Errorf("invalid tcc transaction record %s : %v", kv.Key, err)
+			continue
+		}
+		getTransaction(id).record = record
+	}
+
+	// finished or expired
+	for id, tx := range transactionMap {
+		if tx.record == nil || tx.record.isFinal() {
+			delete(transactionMap, id)
+		}
+	}
+	return transactionMap, nil
+}
+
+// recoverTCCTransaction cancel or complete the transaction of a lost coordinator
+func recoverTCCTransaction(ctx context.Context, transactionID string, tx *tccRecoveryTransaction) error {
+	record := tx.record
+
+	// coordinator alive
+	aliveResp, err := etcdClient.Get(ctx, getTCCAliveKey(transactionID), clientv3.WithCountOnly())
+	if err != nil {
+		return ErrTCCInvalidGet
+	}
+	isAlive := aliveResp.Count > 0
+
+	switch record.Status {
+	case TCCStatusTrying:
+		// cancel : coordinator lost or timeout
+		if !isAlive {
+			_, _, _, err = decideTCCTransaction(ctx, etcdClient, transactionID, false, "recovery : coordinator lost")
+		} else if time.Now().UnixNano() > record.Deadline {
+			_, _, _, err = decideTCCTransaction(ctx, etcdClient, transactionID, false, "recovery : timeout")
+		}
+		return err
+
+	case TCCStatusConfirming, TCCStatusCancelling:
+		// complete : all branches finished
+		if isAlive {
+			return nil
+		}
+		var isFinished = true
+		for _, branch := range tx.branches {
+			if branch.isFinal() {
+				continue
+			}
+			isFinished = false
+
+			// not recovered : the participant is not registered in any process
+			if time.Since(time.Unix(0, branch.UpdatedAt)) > defaultTCCTransactionTimeout {
+				logrus.Warnf("tcc branch %s of transaction %s is %s since %s : register the participant by RegisterTCCParticipant to recover it",
+					branch.ParticipantID, transactionID, branch.Status, time.Unix(0, branch.UpdatedAt).Format(time.RFC3339))
+			}
+		}
+		if !isFinished {
+			return nil
+		}
+		_, err = completeTCCTransaction(ctx, etcdClient, transactionID)
+		return err
+	}
+	return nil
+}
+
+// recover confirm or cancel the decided branch of this participant
+func (p *TCCParticipant) recover(ctx context.Context, transactionID string, tx *tccRecoveryTransaction) error {
+	// client
+	if p.ETCDClient == nil {
+		p.ETCDClient = etcdClient
+	}
+
+	if tx.record.Status != TCCStatusConfirming && tx.record.Status != TCCStatusCancelling {
+		return nil
+	}
+
+	// branch not finished
+	branch, ok := tx.branches[getTCCBranchKey(transactionID, p.ParticipantID)]
+	if !ok || branch.isFinal() {
+		return nil
+	}
+	p.finish(ctx, transactionID, tx.record.Status, 1)
+	return nil
+}
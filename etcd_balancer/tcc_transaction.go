@@ -0,0 +1,657 @@
+package balancer
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/rs/xid"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// tcc transaction config
+const (
+	tccTransactionKeyPrefix      = "try_confirm_cancel/tx/"    // etcd key prefix : durable records
+	tccTransactionAliveKeyPrefix = "try_confirm_cancel/alive/" // etcd key prefix : coordinator alive
+	tccTransactionBranchKey      = "/branch/"                  // tx key + branch key + participant id
+	tccTransactionMetadataKey    = "x-tcc-transaction-id"      // grpc metadata key
+
+	defaultTCCTransactionTimeout       = 30 * time.Second       // try timeout, cancelled by recovery after it
+	defaultTCCRecordRetention    int64 = 24 * 60 * 60           // finished record etcd ttl(24h)
+	defaultTCCRetryMinInterval         = 100 * time.Millisecond // confirm / cancel retry min interval
+	defaultTCCRetryMaxInterval         = 3 * time.Second        // confirm / cancel retry max interval
+	defaultTCCRetryMaxTimes            = 10                     // confirm / cancel retry times, then left to recovery
+)
+
+// tcc transaction status
+const (
+	TCCStatusTrying     = "trying"     // transaction & branch : try
+	TCCStatusTried      = "tried"      // branch : try success
+	TCCStatusTryFailed  = "try_failed" // branch : try fail
+	TCCStatusConfirming = "confirming" // transaction & branch : decision confirm
+	TCCStatusCancelling = "cancelling" // transaction & branch : decision cancel
+	TCCStatusConfirmed  = "confirmed"  // transaction & branch : confirm done
+	TCCStatusCancelled  = "cancelled"  // transaction & branch : cancel done
+)
+
+// err
+var (
+	ErrTCCNoTransaction   = status.Error(codes.FailedPrecondition, "no try confirm cancel transaction in metadata")
+	ErrTCCTransactionDone = status.Error(codes.Aborted, "try confirm cancel transaction is done")
+	ErrTCCInvalidRecord   = status.Error(codes.Internal, "invalid try confirm cancel record")
+	ErrTCCCancelled       = status.Error(codes.Aborted, "try confirm cancel transaction cancelled")
+)
+
+// participants of this process : participant id => *TCCParticipant
+var (
+	tccParticipantMap sync.Map
+)
+
+// TCCTransactionRecord transaction record : try_confirm_cancel/tx/{id}
+type TCCTransactionRecord struct {
+	TransactionID string        `json:"transaction_id"`         // transaction id
+	Status        string        `json:"status"`                 // transaction status
+	Participants  []string      `json:"participants,omitempty"` // expected participants
+	Deadline      int64         `json:"deadline"`               // unix nano, trying is cancelled after it
+	Decisions     []TCCDecision `json:"decisions,omitempty"`    // decision log
+	UpdatedAt     int64         `json:"updated_at"`             // unix nano
+}
+
+// TCCDecision decision log
+type TCCDecision struct {
+	Status    string `json:"status"`           // transaction status
+	Reason    string `json:"reason,omitempty"` // reason
+	CreatedAt int64  `json:"created_at"`       // unix nano
+}
+
+// TCCBranchRecord participant record : try_confirm_cancel/tx/{id}/branch/{participant id}
+type TCCBranchRecord struct {
+	ParticipantID string `json:"participant_id"`         // participant id
+	Status        string `json:"status"`                 // branch status
+	Error         string `json:"error,omitempty"`        // last error
+	EmptyCancel   bool   `json:"empty_cancel,omitempty"` // cancelled before try, the late try is rejected
+	UpdatedAt     int64  `json:"updated_at"`             // unix nano
+}
+
+// isFinal confirmed or cancelled
+func (r *TCCTransactionRecord) isFinal() bool {
+	return r.Status == TCCStatusConfirmed || r.Status == TCCStatusCancelled
+}
+
+// isFinal confirmed or cancelled
+func (r *TCCBranchRecord) isFinal() bool {
+	return r.Status == TCCStatusConfirmed || r.Status == TCCStatusCancelled
+}
+
+// getTCCTransactionKey transaction key
+func getTCCTransactionKey(transactionID string) string {
+	return tccTransactionKeyPrefix + transactionID
+}
+
+// getTCCBranchKey branch key
+func getTCCBranchKey(transactionID, participantID string) string {
+	return getTCCTransactionKey(transactionID) + tccTransactionBranchKey + participantID
+}
+
+// getTCCAliveKey coordinator alive key
+func getTCCAliveKey(transactionID string) string {
+	return tccTransactionAliveKeyPrefix + transactionID
+}
+
+// TransactionIDFromContext transaction id in the incoming metadata
+func TransactionIDFromContext(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if data := md.Get(tccTransactionMetadataKey); len(data) > 0 {
+			return data[0]
+		}
+	}
+	return ""
+}
+
+// Transaction try confirm cancel coordinator
+//
+// the transaction id is propagated to the participants in grpc metadata, the
+// participants join with TCCParticipant.Join. Commit drives every participant
+// to Confirm if all try succeed, to Cancel otherwise.
+//
+// the records are durable, the coordinator only holds a leased alive key : if
+// it crashes, the recovery worker finishes the transaction.
+type Transaction struct {
+	ETCDClient    *clientv3.Client // etcd client
+	TransactionID string           // transaction id
+	TCCKeyTTL     int64            // coordinator alive key etcd ttl
+
+	leaseID  clientv3.LeaseID
+	cancelFn context.CancelFunc // stop keep alive
+}
+
+// NewTransaction start a transaction, the expected participants are cancelled
+// even if their try has not arrived
+func NewTransaction(ctx context.Context, participants ...string) (*Transaction, error) {
+	t := &Transaction{
+		ETCDClient:    etcdClient,
+		TransactionID: xid.New().String(),
+		TCCKeyTTL:     defaultTryConfirmCancelETCDAliveTTL,
+	}
+
+	// etcd alive ttl
+	leaseResp, err := t.ETCDClient.Grant(ctx, t.TCCKeyTTL)
+	if err != nil {
+		return nil, ErrTCCInvalidLease
+	}
+	t.leaseID = leaseResp.ID
+
+	// keep alive until done
+	keepAliveCtx, cancelFn := context.WithCancel(context.Background())
+	t.cancelFn = cancelFn
+	keepAliveChan, err := t.ETCDClient.KeepAlive(keepAliveCtx, t.leaseID)
+	if err != nil {
+		t.stop()
+		return nil, ErrTCCInvalidLease
+	}
+	go func() {
+		for range keepAliveChan {
+			// drain
+		}
+	}()
+
+	// transaction record & alive key
+	now := time.Now()
+	record := &TCCTransactionRecord{
+		TransactionID: t.TransactionID,
+		Status:        TCCStatusTrying,
+		Participants:  participants,
+		Deadline:      now.Add(defaultTCCTransactionTimeout).UnixNano(),
+		Decisions:     []TCCDecision{{Status: TCCStatusTrying, CreatedAt: now.UnixNano()}},
+		UpdatedAt:     now.UnixNano(),
+	}
+	value, _ := json.Marshal(record)
+	if _, err := t.ETCDClient.Txn(ctx).Then(
+		clientv3.OpPut(getTCCTransactionKey(t.TransactionID), string(value)),
+		clientv3.OpPut(getTCCAliveKey(t.TransactionID), t.TransactionID, clientv3.WithLease(t.leaseID)),
+	).Commit(); err != nil {
+		t.stop()
+		return nil, ErrTCCInvalidPut
+	}
+	return t, nil
+}
+
+// NewOutgoingContext put transaction id to the outgoing metadata
+func (t *Transaction) NewOutgoingContext(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, tccTransactionMetadataKey, t.TransactionID)
+}
+
+// Commit confirm if all try succeed, cancel otherwise; returns ErrTCCCancelled
+// if the transaction is cancelled
+func (t *Transaction) Commit(ctx context.Context) error {
+	return t.finish(ctx, true, "commit")
+}
+
+// Rollback cancel all participants
+func (t *Transaction) Rollback(ctx context.Context) error {
+	return t.finish(ctx, false, "rollback")
+}
+
+// finish decide, wait all participants and revoke the alive key
+func (t *Transaction) finish(ctx context.Context, isConfirm bool, reason string) error {
+	// alive key is removed : left to the recovery worker if not finished
+	defer t.stop()
+
+	// decide
+	record, branchMap, revision, err := decideTCCTransaction(ctx, t.ETCDClient, t.TransactionID, isConfirm, reason)
+	if err != nil {
+		return err
+	}
+
+	// wait participants
+	if !record.isFinal() {
+		if err := waitTCCBranches(ctx, t.ETCDClient, t.TransactionID, branchMap, revision); err != nil {
+			return err
+		}
+		if record, err = completeTCCTransaction(ctx, t.ETCDClient, t.TransactionID); err != nil {
+			return err
+		}
+	}
+
+	if record.Status == TCCStatusCancelled {
+		return ErrTCCCancelled
+	}
+	return nil
+}
+
+// stop stop keep alive and revoke the alive key
+func (t *Transaction) stop() {
+	t.cancelFn()
+	ctx, cancelFn := context.WithTimeout(context.Background(), defaultRegisterRevokeTimeout)
+	t.ETCDClient.Revoke(ctx, t.leaseID)
+	cancelFn()
+}
+
+// getTCCTransaction transaction record & branches
+func getTCCTransaction(ctx context.Context, client *clientv3.Client, transactionID string) (*TCCTransactionRecord, *mvccpb.KeyValue, map[string]*TCCBranchRecord, *clientv3.GetResponse, error) {
+	txKey := getTCCTransactionKey(transactionID)
+	getResp, err := client.Get(ctx, txKey, clientv3.WithPrefix())
+	if err != nil {
+		return nil, nil, nil, nil, ErrTCCInvalidGet
+	}
+
+	var (
+		record    *TCCTransactionRecord
+		txKv      *mvccpb.KeyValue
+		branchMap = make(map[string]*TCCBranchRecord)
+	)
+	for _, kv := range getResp.Kvs {
+		switch {
+		case string(kv.Key) == txKey:
+			txKv, record = kv, new(TCCTransactionRecord)
+			if err := json.Unmarshal(kv.Value, record); err != nil {
+				return nil, nil, nil, nil, ErrTCCInvalidRecord
+			}
+
+		case strings.HasPrefix(string(kv.Key), txKey+tccTransactionBranchKey):
+			branch := new(TCCBranchRecord)
+			if err := json.Unmarshal(kv.Value, branch); err != nil {
+				return nil, nil, nil, nil, ErrTCCInvalidRecord
+			}
+			branchMap[string(kv.Key)] = branch
+		}
+	}
+
+	// expired after retention
+	if record == nil {
+		return nil, nil, nil, nil, ErrTCCLeaseExpired
+	}
+	return record, txKv, branchMap, getResp, nil
+}
+
+// decideTCCTransaction put the decision in one etcd txn with the branches it
+// is based on; a transaction already decided keeps its decision
+//
+// branchMap : branch key => is final
+func decideTCCTransaction(ctx context.Context, client *clientv3.Client, transactionID string, isConfirm bool, reason string) (record *TCCTransactionRecord, branchMap map[string]bool, revision int64, err error) {
+	txKey := getTCCTransactionKey(transactionID)
+	for {
+		record, txKv, branches, getResp, err := getTCCTransaction(ctx, client, transactionID)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+
+		// branches
+		branchMap = make(map[string]bool, len(branches))
+		decision := TCCStatusConfirming
+		if !isConfirm {
+			decision = TCCStatusCancelling
+		}
+		for key, branch := range branches {
+			branchMap[key] = branch.isFinal()
+			if branch.Status != TCCStatusTried {
+				decision = TCCStatusCancelling
+			}
+		}
+
+		// an expected participant not joined
+		for _, participantID := range record.Participants {
+			if _, ok := branchMap[getTCCBranchKey(transactionID, participantID)]; !ok {
+				decision = TCCStatusCancelling
+			}
+		}
+
+		// decided
+		if record.Status != TCCStatusTrying {
+			return record, branchMap, getResp.Header.Revision, nil
+		}
+
+		// decision log
+		now := time.Now().UnixNano()
+		record.Status, record.UpdatedAt = decision, now
+		record.Decisions = append(record.Decisions, TCCDecision{Status: decision, Reason: reason, CreatedAt: now})
+		value, _ := json.Marshal(record)
+		ops := []clientv3.Op{clientv3.OpPut(txKey, string(value))}
+
+		// cancel before try : record the expected participants not joined
+		if decision == TCCStatusCancelling {
+			for _, participantID := range record.Participants {
+				branchKey := getTCCBranchKey(transactionID, participantID)
+				if _, ok := branchMap[branchKey]; ok {
+					continue
+				}
+				branchValue, _ := json.Marshal(&TCCBranchRecord{
+					ParticipantID: participantID,
+					Status:        TCCStatusCancelled,
+					EmptyCancel:   true,
+					UpdatedAt:     now,
+				})
+				ops = append(ops, clientv3.OpPut(branchKey, string(branchValue)))
+			}
+		}
+
+		// decision : no branch changed since the get
+		branchPrefix := txKey + tccTransactionBranchKey
+		txnResp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(txKey), "=", txKv.ModRevision),
+				clientv3.Compare(clientv3.ModRevision(branchPrefix), "<", getResp.Header.Revision+1).WithPrefix()).
+			Then(ops...).
+			Commit()
+		if err != nil {
+			return nil, nil, 0, ErrTCCInvalidPut
+		}
+		if txnResp.Succeeded {
+			return record, branchMap, txnResp.Header.Revision, nil
+		}
+		// a branch changed : decide again
+	}
+}
+
+// waitTCCBranches wait all branches confirmed or cancelled
+func waitTCCBranches(ctx context.Context, client *clientv3.Client, transactionID string, branchMap map[string]bool, revision int64) error {
+	isDone := func() bool {
+		for _, done := range branchMap {
+			if !done {
+				return false
+			}
+		}
+		return true
+	}
+	if isDone() {
+		return nil
+	}
+
+	watchCtx, watchCancelFn := context.WithCancel(ctx)
+	defer watchCancelFn()
+	branchPrefix := getTCCTransactionKey(transactionID) + tccTransactionBranchKey
+	rch := client.Watch(watchCtx, branchPrefix, clientv3.WithPrefix(), clientv3.WithRev(revision+1))
+	for n := range rch {
+		for _, ev := range n.Events {
+			if ev.Type == mvccpb.DELETE {
+				return ErrTCCLeaseExpired
+			}
+			var branch TCCBranchRecord
+			if err := json.Unmarshal(ev.Kv.Value, &branch); err != nil {
+				return ErrTCCInvalidRecord
+			}
+			if branch.isFinal() {
+				branchMap[string(ev.Kv.Key)] = true
+			}
+		}
+
+		// all done
+		if isDone() {
+			return nil
+		}
+	}
+
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return ErrTCCTimeout
+	case context.Canceled:
+		return ErrTCCCanceled
+	}
+	return ErrTCCInvalidWatch
+}
+
+// completeTCCTransaction put the final status, the records expire after retention
+func completeTCCTransaction(ctx context.Context, client *clientv3.Client, transactionID string) (*TCCTransactionRecord, error) {
+	record, txKv, branches, _, err := getTCCTransaction(ctx, client, transactionID)
+	if err != nil {
+		return nil, err
+	} else if record.isFinal() {
+		return record, nil
+	}
+
+	// final status
+	final := TCCStatusConfirmed
+	if record.Status == TCCStatusCancelling {
+		final = TCCStatusCancelled
+	}
+	now := time.Now().UnixNano()
+	record.Status, record.UpdatedAt = final, now
+	record.Decisions = append(record.Decisions, TCCDecision{Status: final, CreatedAt: now})
+
+	// retention
+	leaseResp, err := client.Grant(ctx, defaultTCCRecordRetention)
+	if err != nil {
+		return nil, ErrTCCInvalidLease
+	}
+	value, _ := json.Marshal(record)
+	ops := []clientv3.Op{clientv3.OpPut(getTCCTransactionKey(transactionID), string(value), clientv3.WithLease(leaseResp.ID))}
+	for key, branch := range branches {
+		branchValue, _ := json.Marshal(branch)
+		ops = append(ops, clientv3.OpPut(key, string(branchValue), clientv3.WithLease(leaseResp.ID)))
+	}
+
+	txnResp, err := client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(string(txKv.Key)), "=", txKv.ModRevision)).
+		Then(ops...).
+		Commit()
+	if err != nil {
+		return nil, ErrTCCInvalidPut
+	} else if !txnResp.Succeeded {
+		// completed by another instance
+		record, _, _, _, err = getTCCTransaction(ctx, client, transactionID)
+		return record, err
+	}
+	return record, nil
+}
+
+// RegisterTCCParticipant register participant of this process for the recovery worker
+func RegisterTCCParticipant(p *TCCParticipant) {
+	tccParticipantMap.Store(p.ParticipantID, p)
+}
+
+// TCCParticipant try confirm cancel participant
+//
+// Join runs Try in the transaction of the incoming metadata, then Confirm or
+// Cancel is called when the coordinator decides. Confirm and Cancel are
+// retried, the recovery worker retries them after a crash.
+//
+// a repeated Confirm or Cancel is a no-op once the branch is confirmed or
+// cancelled, a Try after its Cancel is rejected.
+type TCCParticipant struct {
+	ETCDClient    *clientv3.Client                                                       // etcd client
+	ParticipantID string                                                                 // unique in a transaction
+	Try           func(ctx context.Context, transactionID string, req interface{}) error // reserve
+	Confirm       func(ctx context.Context, transactionID string) error                  // commit the reservation
+	Cancel        func(ctx context.Context, transactionID string) error                  // release the reservation
+
+	runningMap sync.Map // branch key => confirm or cancel is running
+}
+
+// Join run Try in the transaction of the incoming metadata
+func (p *TCCParticipant) Join(ctx context.Context, req interface{}) error {
+	transactionID := TransactionIDFromContext(ctx)
+	if len(transactionID) == 0 {
+		return ErrTCCNoTransaction
+	}
+
+	// client
+	if p.ETCDClient == nil {
+		p.ETCDClient = etcdClient
+	}
+
+	// transaction is trying
+	txKey := getTCCTransactionKey(transactionID)
+	getResp, err := p.ETCDClient.Get(ctx, txKey)
+	if err != nil {
+		return ErrTCCInvalidGet
+	} else if getResp.Count == 0 {
+		return ErrTCCLeaseExpired
+	}
+	txKv := getResp.Kvs[0]
+	var record TCCTransactionRecord
+	if err := json.Unmarshal(txKv.Value, &record); err != nil {
+		return ErrTCCInvalidRecord
+	} else if record.Status != TCCStatusTrying || time.Now().UnixNano() > record.Deadline {
+		return ErrTCCTransactionDone
+	}
+
+	// join : transaction not decided and branch not exists
+	branchKey := getTCCBranchKey(transactionID, p.ParticipantID)
+	value, _ := json.Marshal(p.newRecord(TCCStatusTrying, nil))
+	txnResp, err := p.ETCDClient.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(txKey), "=", txKv.ModRevision),
+			clientv3.Compare(clientv3.CreateRevision(branchKey), "=", 0)).
+		Then(clientv3.OpPut(branchKey, string(value))).
+		Else(clientv3.OpGet(branchKey)).
+		Commit()
+	if err != nil {
+		return ErrTCCInvalidPut
+	} else if !txnResp.Succeeded {
+		// repeated try is a no-op, the try after cancel is rejected
+		if kvs := txnResp.Responses[0].GetResponseRange().Kvs; len(kvs) > 0 {
+			var branch TCCBranchRecord
+			if err := json.Unmarshal(kvs[0].Value, &branch); err == nil && branch.Status == TCCStatusTried {
+				return nil
+			}
+		}
+		return ErrTCCTransactionDone
+	}
+
+	// try
+	tryErr := p.Try(ctx, transactionID, req)
+	branchStatus := TCCStatusTried
+	if tryErr != nil {
+		branchStatus = TCCStatusTryFailed
+	}
+	value, _ = json.Marshal(p.newRecord(branchStatus, tryErr))
+	putResp, err := p.ETCDClient.Txn(context.Background()).
+		If(clientv3.Compare(clientv3.ModRevision(branchKey), "=", txnResp.Header.Revision)).
+		Then(clientv3.OpPut(branchKey, string(value))).
+		Commit()
+	if err != nil {
+		logrus.Errorf("TCCParticipant put branch error : %v", err)
+	} else if !putResp.Succeeded {
+		// the branch is changed during try, e.g. cancelled by recovery : not overwritten
+		logrus.Errorf("TCCParticipant %s branch changed during try : %s", p.ParticipantID, transactionID)
+		if tryErr == nil {
+			tryErr = ErrTCCTransactionDone
+		}
+	}
+
+	// wait decision : after try, the cancel never runs before its try
+	revision := txnResp.Header.Revision
+	if putResp != nil {
+		revision = putResp.Header.Revision
+	}
+	go p.waitDecision(transactionID, revision)
+	return tryErr
+}
+
+// waitDecision watch the transaction record, then confirm or cancel
+func (p *TCCParticipant) waitDecision(transactionID string, revision int64) {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+
+	// decided before the watch
+	record, _, _, _, err := getTCCTransaction(ctx, p.ETCDClient, transactionID)
+	if err != nil {
+		logrus.Errorf("TCCParticipant get transaction error : %v", err)
+		return
+	}
+
+	// watch
+	if record.Status == TCCStatusTrying {
+		rch := p.ETCDClient.Watch(ctx, getTCCTransactionKey(transactionID), clientv3.WithRev(revision+1))
+		for n := range rch {
+			for _, ev := range n.Events {
+				if ev.Type != mvccpb.PUT {
+					continue
+				}
+				if err := json.Unmarshal(ev.Kv.Value, record); err != nil {
+					continue
+				}
+			}
+			if record.Status != TCCStatusTrying {
+				break
+			}
+		}
+	}
+	p.finish(ctx, transactionID, record.Status, defaultTCCRetryMaxTimes)
+}
+
+// finish run confirm or cancel until success or retry times, a finished branch is a no-op
+func (p *TCCParticipant) finish(ctx context.Context, transactionID, decision string, retryTimes int) {
+	var (
+		handler  = p.Confirm
+		final    = TCCStatusConfirmed
+		interval = defaultTCCRetryMinInterval
+	)
+	switch decision {
+	case TCCStatusConfirming, TCCStatusConfirmed:
+	case TCCStatusCancelling, TCCStatusCancelled:
+		handler, final = p.Cancel, TCCStatusCancelled
+	default:
+		return
+	}
+
+	// running in this process
+	branchKey := getTCCBranchKey(transactionID, p.ParticipantID)
+	if _, loaded := p.runningMap.LoadOrStore(branchKey, true); loaded {
+		return
+	}
+	defer p.runningMap.Delete(branchKey)
+
+	for i := 0; i < retryTimes; i++ {
+		// finished : no-op
+		getResp, err := p.ETCDClient.Get(ctx, branchKey)
+		if err != nil {
+			logrus.Errorf("TCCParticipant get branch error : %v", err)
+		} else if getResp.Count == 0 {
+			return
+		} else {
+			var branch TCCBranchRecord
+			if err := json.Unmarshal(getResp.Kvs[0].Value, &branch); err != nil || branch.isFinal() {
+				return
+			}
+
+			// confirm or cancel
+			err = handler(ctx, transactionID)
+			if err == nil {
+				if _, err := putTCCRecord(ctx, p.ETCDClient, branchKey, p.newRecord(final, nil)); err != nil {
+					logrus.Errorf("TCCParticipant put branch error : %v", err)
+				}
+				return
+			}
+			logrus.Errorf("TCCParticipant %s %s error : %v", p.ParticipantID, final, err)
+			putTCCRecord(ctx, p.ETCDClient, branchKey, p.newRecord(decision, err))
+		}
+
+		// backoff
+		time.Sleep(interval)
+		if interval *= 2; interval > defaultTCCRetryMaxInterval {
+			interval = defaultTCCRetryMaxInterval
+		}
+	}
+}
+
+// newRecord branch record
+func (p *TCCParticipant) newRecord(status string, err error) *TCCBranchRecord {
+	record := &TCCBranchRecord{
+		ParticipantID: p.ParticipantID,
+		Status:        status,
+		UpdatedAt:     time.Now().UnixNano(),
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	return record
+}
+
+// putTCCRecord put json record
+func putTCCRecord(ctx context.Context, client *clientv3.Client, key string, record interface{}, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return nil, ErrTCCInvalidRecord
+	}
+	putResp, err := client.Put(ctx, key, string(value), opts...)
+	if err != nil {
+		return nil, ErrTCCInvalidPut
+	}
+	return putResp, nil
+}
@@ -1,31 +1,97 @@
 package balancer
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"time"
+
 	"github.com/coreos/etcd/clientv3"
 	"github.com/coreos/etcd/mvcc/mvccpb"
 	"github.com/rs/xid"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	"sync"
-	"time"
 )
 
 // etcd try confirm cancel config
 const (
-	defaultTryConfirmCancelETCDAliveTTL  int64 = 10  // etcd alive ttl(10s)
-	defaultTryConfirmCancelStatusInitial       = "0" // initial status
-	defaultTryConfirmCancelStatusSuccess       = "1" // success status
-	defaultTryConfirmCancelStatusFail          = "2" // fail status
+	defaultTryConfirmCancelETCDAliveTTL int64 = 10 // etcd alive ttl(10s)
+	tryValueVersion                           = 1  // try value json version
 )
 
+// TryStatus try status, the bare string of the old value format
+type TryStatus string
+
+// try status
+const (
+	TryStatusInitial TryStatus = "0" // initial status
+	TryStatusSuccess TryStatus = "1" // success status
+	TryStatusFail    TryStatus = "2" // fail status
+)
+
+// TryValue try key value : versioned json document
+//
+// the old value format is the bare status string, read as version 0
+type TryValue struct {
+	Version       int             `json:"version"`                  // value version
+	Status        TryStatus       `json:"status"`                   // try status
+	ParticipantID string          `json:"participant_id,omitempty"` // participant id
+	Error         string          `json:"error,omitempty"`          // fail reason
+	Timestamp     int64           `json:"timestamp"`                // unix nano
+	Result        json.RawMessage `json:"result,omitempty"`         // result payload
+}
+
+// TryOutcome participant outcome
+type TryOutcome struct {
+	Key string // etcd key
+	*TryValue
+}
+
+// TCCReport per participant outcome report
+type TCCReport struct {
+	IsReady  bool          // all try success
+	Outcomes []*TryOutcome // outcome per try key, in TCCKeySlice order
+}
+
+// parseTryValue read json document or bare status string
+func parseTryValue(data []byte) (*TryValue, error) {
+	value := new(TryValue)
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		if err := json.Unmarshal(data, value); err != nil {
+			return nil, ErrTCCInvalidTCC
+		}
+	} else {
+		value.Status = TryStatus(data)
+	}
+
+	switch value.Status {
+	case TryStatusInitial, TryStatusSuccess, TryStatusFail:
+		return value, nil
+	}
+	return nil, ErrTCCInvalidTCC
+}
+
+// newTryValue try value
+func newTryValue(status TryStatus, participantID string) *TryValue {
+	return &TryValue{
+		Version:       tryValueVersion,
+		Status:        status,
+		ParticipantID: participantID,
+		Timestamp:     time.Now().UnixNano(),
+	}
+}
+
 // err
 var (
 	ErrTCCInvalidLease = status.Error(codes.Internal, "ETCDClient.Grant lease fail")
 	ErrTCCInvalidPut   = status.Error(codes.Internal, "ETCDClient.Put fail")
 	ErrTCCInvalidGet   = status.Error(codes.Internal, "ETCDClient.Get fail")
 	ErrTCCInvalidTCC   = status.Error(codes.Internal, "try confirm cancel fail")
+	ErrTCCInvalidWatch = status.Error(codes.Internal, "ETCDClient.Watch fail")
+	ErrTCCLeaseExpired = status.Error(codes.Aborted, "try confirm cancel lease expired")
+	ErrTCCTimeout      = status.Error(codes.DeadlineExceeded, "try confirm cancel timeout")
+	ErrTCCCanceled     = status.Error(codes.Canceled, "try confirm cancel canceled")
 )
 
 // TryConfirmCancel 尝试-确认-取消
@@ -75,7 +141,8 @@ func (e *TryConfirmCancel) PutTryKeyValue(tryNumber int) error {
 		// lock ley
 		e.TCCKeySlice[i] = fmt.Sprintf("%s_%d", e.TCCKeyPrefix, i)
 		// save to etcd
-		_, err = e.ETCDClient.Put(context.Background(), e.TCCKeySlice[i], defaultTryConfirmCancelStatusInitial, clientv3.WithLease(leaseResp.ID))
+		value, _ := json.Marshal(newTryValue(TryStatusInitial, ""))
+		_, err = e.ETCDClient.Put(context.Background(), e.TCCKeySlice[i], string(value), clientv3.WithLease(leaseResp.ID))
 		if err != nil {
 			return ErrTCCInvalidPut
 		}
@@ -83,12 +150,36 @@ func (e *TryConfirmCancel) PutTryKeyValue(tryNumber int) error {
 	return nil
 }
 
-// WatchTryKeyValue watch try
-func (e *TryConfirmCancel) WatchTryKeyValue() (isReady bool, err error) {
+// WatchTryKeyValue watch try, blocks until all try success, one try fail or
+// the tcc lease expires
+func (e *TryConfirmCancel) WatchTryKeyValue() (*TCCReport, error) {
+	return e.WatchTryKeyValueWithContext(context.Background())
+}
+
+// WatchTryKeyValueWithContext watch try, blocks until ready or ctx is done
+func (e *TryConfirmCancel) WatchTryKeyValueWithContext(ctx context.Context) (*TCCReport, error) {
+	result := <-e.WatchTryKeyValueChan(ctx)
+	return result.Report, result.Err
+}
+
+// TCCResult try result
+type TCCResult struct {
+	Report *TCCReport // outcome report
+	Err    error      // fail reason
+}
+
+// WatchTryKeyValueChan watch try, the result is sent once and the channel is closed
+//
+// the watch starts from the revision of the initial get, the updates between
+// the get and the watch are not lost.
+func (e *TryConfirmCancel) WatchTryKeyValueChan(ctx context.Context) <-chan TCCResult {
+	resultChan := make(chan TCCResult, 1)
+
 	// invalid try number
 	if len(e.TCCKeySlice) <= 1 {
-		isReady = true
-		return isReady, nil
+		resultChan <- TCCResult{Report: &TCCReport{IsReady: true}}
+		close(resultChan)
+		return resultChan
 	}
 
 	// client
@@ -96,166 +187,169 @@ func (e *TryConfirmCancel) WatchTryKeyValue() (isReady bool, err error) {
 		e.NewETCDClient()
 	}
 
-	// try key map
-	var tccKeyMap sync.Map
+	go func() {
+		defer close(resultChan)
+		report, err := e.watchTryKeyValue(ctx)
+		resultChan <- TCCResult{Report: report, Err: err}
+	}()
+	return resultChan
+}
+
+// watchTryKeyValue get try value, then watch from the get revision
+func (e *TryConfirmCancel) watchTryKeyValue(ctx context.Context) (*TCCReport, error) {
+	// report
+	var (
+		report     = &TCCReport{Outcomes: make([]*TryOutcome, len(e.TCCKeySlice))}
+		outcomeMap = make(map[string]*TryOutcome, len(e.TCCKeySlice))
+	)
 	for i := range e.TCCKeySlice {
-		tccKeyMap.Store(e.TCCKeySlice[i], false)
+		report.Outcomes[i] = &TryOutcome{Key: e.TCCKeySlice[i], TryValue: &TryValue{Status: TryStatusInitial}}
+		outcomeMap[e.TCCKeySlice[i]] = report.Outcomes[i]
 	}
 
-	// polling
-	return e.pollingTryKeyValue(tccKeyMap)
-
-	// watch : if the processing time too short, goroutine will blocking
-	//isReadyChannel := make(chan bool)
-	//go e.watchTryKeyValue(tccKeyMap, isReadyChannel)
-	// block
-	//select {
-	//case isReady := <-isReadyChannel:
-	//	if !isReady {
-	//		return isReady, ErrTCCInvalidTCC
-	//	}
-	//	return isReady, err
-	//}
-}
-
-// pollingTryKeyValue polling try value
-func (e *TryConfirmCancel) pollingTryKeyValue(tccKeyMap sync.Map) (isReady bool, err error) {
 	// etcd key value
-	getResp, err := e.ETCDClient.Get(context.Background(), e.TCCKeyPrefix, clientv3.WithPrefix())
+	getResp, err := e.ETCDClient.Get(ctx, e.TCCKeyPrefix, clientv3.WithPrefix())
 	if err != nil {
-		return isReady, ErrTCCInvalidGet
+		return report, e.watchError(ctx, ErrTCCInvalidGet)
+	} else if getResp.Count == 0 {
+		return report, ErrTCCLeaseExpired
 	} else if getResp.Count != int64(len(e.TCCKeySlice)) {
-		return isReady, ErrTCCInvalidTCC
+		return report, ErrTCCInvalidTCC
 	}
 
 	// check has success
 	for i := range getResp.Kvs {
-		// logrus.Printf("%q : %q\n", getResp.Kvs[i].Value, getResp.Kvs[i].Value)
-		switch string(getResp.Kvs[i].Value) {
-
-		case defaultTryConfirmCancelStatusSuccess:
-			// is success
-			if err = e.PutStatusSuccess(string(getResp.Kvs[i].Key)); err != nil {
-				return isReady, err
-			}
-			tccKeyMap.Store(string(getResp.Kvs[i].Key), true)
-			// ready
-			if e.isReady(tccKeyMap) {
-				isReady = true
-				return isReady, err
-			}
-
-		case defaultTryConfirmCancelStatusFail:
-			// is fail
-			if err = e.PutStatusFail(string(getResp.Kvs[i].Key)); err != nil {
-				isReady = false
-				return isReady, err
-			}
-			isReady = false
-			return isReady, err
-
-		case defaultTryConfirmCancelStatusInitial:
-			// is initial
-
-		default:
-			// default
-			isReady = false
-			return isReady, ErrTCCInvalidTCC
+		if isDone, err := e.checkTryValue(report, outcomeMap, getResp.Kvs[i]); isDone {
+			return report, err
 		}
 	}
 
-	// do again
-	time.Sleep(time.Millisecond)
-
-	return e.pollingTryKeyValue(tccKeyMap)
-}
-
-// watchTryKeyValue all try is ready
-//
-// if the processing time too short, the goroutine will blocking
-func (e *TryConfirmCancel) watchTryKeyValue(tccKeyMap sync.Map, isReadyChannel chan bool) {
-	// watch
-	rch := e.ETCDClient.Watch(context.Background(), e.TCCKeyPrefix, clientv3.WithPrefix())
+	// watch after the get revision
+	watchCtx, watchCancelFn := context.WithCancel(ctx)
+	defer watchCancelFn()
+	rch := e.ETCDClient.Watch(watchCtx, e.TCCKeyPrefix, clientv3.WithPrefix(), clientv3.WithRev(getResp.Header.Revision+1))
 	for n := range rch {
+		if n.Err() != nil {
+			return report, e.watchError(ctx, ErrTCCInvalidWatch)
+		}
+
 		// etcd events
 		for _, ev := range n.Events {
 			// logrus.Printf("%s %q : %q\n", ev.Type, ev.Kv.Key, ev.Kv.Value)
 			switch ev.Type {
 			case mvccpb.PUT:
-				switch string(ev.Kv.Value) {
-
-				case defaultTryConfirmCancelStatusSuccess:
-					// is success
-					tccKeyMap.Store(string(ev.Kv.Key), true)
-					// is ready
-					if e.isReady(tccKeyMap) {
-						isReadyChannel <- true
-						return
-					}
-
-				case defaultTryConfirmCancelStatusFail:
-					// is fail
-					isReadyChannel <- false
-					return
-
-				case defaultTryConfirmCancelStatusInitial:
-					// is initial
-
-				default:
-					// default
-					isReadyChannel <- false
-					return
-
+				if isDone, err := e.checkTryValue(report, outcomeMap, ev.Kv); isDone {
+					return report, err
 				}
 
 			case mvccpb.DELETE:
-				// is fail
-				isReadyChannel <- false
-				return
+				// lease expired
+				return report, ErrTCCLeaseExpired
 			}
 		}
 	}
+	return report, e.watchError(ctx, ErrTCCInvalidWatch)
+}
+
+// checkTryValue check try value, isDone : all try success or one try fail
+func (e *TryConfirmCancel) checkTryValue(report *TCCReport, outcomeMap map[string]*TryOutcome, kv *mvccpb.KeyValue) (isDone bool, err error) {
+	outcome, ok := outcomeMap[string(kv.Key)]
+	if !ok {
+		return true, ErrTCCInvalidTCC
+	}
+	value, err := parseTryValue(kv.Value)
+	if err != nil {
+		return true, err
+	}
+	outcome.TryValue = value
+
+	switch value.Status {
+
+	case TryStatusSuccess:
+		// is success : ready
+		if e.isReady(report) {
+			report.IsReady = true
+			return true, nil
+		}
+
+	case TryStatusFail:
+		// is fail
+		return true, nil
+
+	case TryStatusInitial:
+		// is initial
+	}
+	return false, nil
+}
+
+// watchError ctx error or err
+func (e *TryConfirmCancel) watchError(ctx context.Context, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return ErrTCCTimeout
+	case context.Canceled:
+		return ErrTCCCanceled
+	}
+	return err
 }
 
 // isReady all try is ready
-func (e *TryConfirmCancel) isReady(tccKeyMap sync.Map) bool {
-	var isReady = true
-	// all try is ready
-	tccKeyMap.Range(func(key, value interface{}) bool {
-		if ready, ok := value.(bool); ok {
-			if !ready {
-				isReady = ready
-				return false
-			}
-		} else {
-			isReady = false
+func (e *TryConfirmCancel) isReady(report *TCCReport) bool {
+	for _, outcome := range report.Outcomes {
+		if outcome.Status != TryStatusSuccess {
+			return false
 		}
-		return true
-	})
-	return isReady
+	}
+	return true
 }
 
 // PutStatusSuccess set success
 func (e *TryConfirmCancel) PutStatusSuccess(key string) error {
-	// client
-	if e.ETCDClient == nil {
-		e.NewETCDClient()
+	return e.PutTryValue(key, newTryValue(TryStatusSuccess, ""))
+}
+
+// PutStatusFail set fail
+func (e *TryConfirmCancel) PutStatusFail(key string) error {
+	return e.PutTryValue(key, newTryValue(TryStatusFail, ""))
+}
+
+// PutSuccessResult set success with the participant result payload
+func (e *TryConfirmCancel) PutSuccessResult(key, participantID string, result interface{}) error {
+	value := newTryValue(TryStatusSuccess, participantID)
+	if result != nil {
+		data, err := json.Marshal(result)
+		if err != nil {
+			return ErrTCCInvalidPut
+		}
+		value.Result = data
 	}
+	return e.PutTryValue(key, value)
+}
 
-	if _, err := e.ETCDClient.Put(context.Background(), key, defaultTryConfirmCancelStatusSuccess); err != nil {
-		return ErrTCCInvalidPut
+// PutFailReason set fail with the participant reason
+func (e *TryConfirmCancel) PutFailReason(key, participantID string, reason error) error {
+	value := newTryValue(TryStatusFail, participantID)
+	if reason != nil {
+		value.Error = reason.Error()
 	}
-	return nil
+	return e.PutTryValue(key, value)
 }
 
-// PutStatusFail set fail
-func (e *TryConfirmCancel) PutStatusFail(key string) error {
+// PutTryValue put try value, the key keeps the tcc lease
+func (e *TryConfirmCancel) PutTryValue(key string, value *TryValue) error {
 	// client
 	if e.ETCDClient == nil {
 		e.NewETCDClient()
 	}
 
-	if _, err := e.ETCDClient.Put(context.Background(), key, defaultTryConfirmCancelStatusFail); err != nil {
+	if value.Version == 0 {
+		value.Version = tryValueVersion
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return ErrTCCInvalidPut
+	}
+	if _, err := e.ETCDClient.Put(context.Background(), key, string(data), clientv3.WithIgnoreLease()); err != nil {
 		return ErrTCCInvalidPut
 	}
 	return nil
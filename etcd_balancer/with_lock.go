@@ -0,0 +1,100 @@
+package balancer
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// err
+var (
+	ErrLockLeaseLost = status.Error(codes.Aborted, "lock lease lost")
+)
+
+// LockOptions WithLock options
+type LockOptions struct {
+	LockKeyTTL  int64         // lock key etcd ttl
+	TryOnce     bool          // try once, do not wait
+	WaitTimeout time.Duration // wait for the lock, 0 wait until ctx is done
+}
+
+// lockContextKey the lock held by WithLock in the ctx of fn
+type lockContextKey struct{}
+
+// LockStats WithLock durations
+type LockStats struct {
+	Waited time.Duration // wait for the lock
+	Held   time.Duration // the lock held
+}
+
+// WithLock get lock, run fn and unlock
+//
+// the ctx of fn is cancelled the moment the lock lease is lost, then
+// ErrLockLeaseLost is returned if fn does not return an error. The lock is
+// in the ctx of fn, see LockFromContext.
+func WithLock(ctx context.Context, lockKey string, opts *LockOptions, fn func(ctx context.Context) error) (stats LockStats, err error) {
+	if opts == nil {
+		opts = new(LockOptions)
+	}
+
+	// get lock
+	var (
+		lock      = &DistributedLock{LockKeyTTL: opts.LockKeyTTL}
+		startTime = time.Now()
+	)
+	if opts.TryOnce {
+		_, err = lock.TryLock(lockKey)
+	} else if opts.WaitTimeout > 0 {
+		waitCtx, waitCancelFn := context.WithTimeout(ctx, opts.WaitTimeout)
+		_, err = lock.Lock(waitCtx, lockKey)
+		waitCancelFn()
+	} else {
+		_, err = lock.Lock(ctx, lockKey)
+	}
+	stats.Waited = time.Since(startTime)
+	if err != nil {
+		return stats, err
+	}
+
+	// unlock
+	heldTime := time.Now()
+	defer func() {
+		stats.Held = time.Since(heldTime)
+		if unLockErr := lock.UnLock(); unLockErr != nil {
+			logrus.Errorf("WithLock lock.UnLock error : %v", unLockErr)
+		}
+	}()
+
+	// cancel fn on lease lost
+	fnCtx, cancelFn := context.WithCancel(context.WithValue(ctx, lockContextKey{}, lock))
+	defer cancelFn()
+	go func() {
+		select {
+		case <-lock.Lost():
+			cancelFn()
+		case <-fnCtx.Done():
+		}
+	}()
+
+	// run
+	err = fn(fnCtx)
+
+	// lease lost
+	select {
+	case <-lock.Lost():
+		if err == nil {
+			err = ErrLockLeaseLost
+		}
+	default:
+	}
+	return stats, err
+}
+
+// LockFromContext the lock held by WithLock, nil if not in WithLock
+func LockFromContext(ctx context.Context) *DistributedLock {
+	lock, _ := ctx.Value(lockContextKey{}).(*DistributedLock)
+	return lock
+}
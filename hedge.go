@@ -0,0 +1,135 @@
+package bhgrpcutils
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// hedge config
+const (
+	defaultHedgeMaxAttempts = 2    // attempts, including the first call
+	defaultHedgeRatio       = 0.05 // hedged calls / requests
+	defaultHedgeMinHedges   = 10   // hedged calls allowed per window whatever the ratio
+)
+
+// HedgePolicy method hedge policy, for idempotent read-only methods only
+type HedgePolicy struct {
+	Delay       time.Duration // send the next copy after delay, e.g. the p95 latency
+	MaxAttempts int           // attempts, including the first call
+}
+
+// HedgeConfig client hedge config
+type HedgeConfig struct {
+	Methods   map[string]*HedgePolicy // full method => policy, the other methods are not hedged
+	MaxRatio  float64                 // hedged calls are capped at ratio of the requests
+	MinHedges int                     // hedged calls allowed per window whatever the ratio
+}
+
+// hedgeResult call result
+type hedgeResult struct {
+	reply interface{}
+	err   error
+}
+
+// NewHedgeUnaryClientInterceptor send another copy of the call after the delay
+//
+// the round robin balancer picks the next instance for the copy. the first
+// response wins and the others are cancelled; Unavailable waits for the other
+// copies.
+func NewHedgeUnaryClientInterceptor(cfg *HedgeConfig) grpc.UnaryClientInterceptor {
+	ratio, minHedges := cfg.MaxRatio, cfg.MinHedges
+	if ratio <= 0 {
+		ratio = defaultHedgeRatio
+	}
+	if minHedges <= 0 {
+		minHedges = defaultHedgeMinHedges
+	}
+	budget := newRetryBudget(ratio, minHedges)
+
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		policy, ok := cfg.Methods[method]
+		budget.addRequest()
+		if !ok || policy.Delay <= 0 {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		maxAttempts := policy.MaxAttempts
+		if maxAttempts <= 0 {
+			maxAttempts = defaultHedgeMaxAttempts
+		}
+
+		// cancel the losers
+		hedgeCtx, cancelFn := context.WithCancel(ctx)
+		defer cancelFn()
+
+		resultChan := make(chan hedgeResult, maxAttempts)
+		send := func() {
+			copyReply := reflect.New(reflect.TypeOf(reply).Elem()).Interface()
+			go func() {
+				err := invoker(hedgeCtx, method, req, copyReply, cc, opts...)
+				resultChan <- hedgeResult{reply: copyReply, err: err}
+			}()
+		}
+
+		send()
+		var (
+			sent, done = 1, 0
+			lastErr    error
+		)
+		timer := time.NewTimer(policy.Delay)
+		defer timer.Stop()
+		for {
+			select {
+			case result := <-resultChan:
+				done++
+				// first response wins
+				if result.err == nil {
+					return copyHedgeReply(reply, result.reply)
+				}
+				lastErr = result.err
+				if status.Code(result.err) != codes.Unavailable || (done == sent && sent == maxAttempts) {
+					return result.err
+				}
+				// Unavailable : send the next copy now
+				if done == sent {
+					if !budget.allowRetry() {
+						return result.err
+					}
+					send()
+					sent++
+				}
+
+			case <-timer.C:
+				if sent < maxAttempts && budget.allowRetry() {
+					send()
+					sent++
+					timer.Reset(policy.Delay)
+				}
+
+			case <-ctx.Done():
+				if lastErr != nil {
+					return lastErr
+				}
+				return status.FromContextError(ctx.Err()).Err()
+			}
+		}
+	}
+}
+
+// copyHedgeReply copy the winner reply
+func copyHedgeReply(reply, winner interface{}) error {
+	dst, ok1 := reply.(proto.Message)
+	src, ok2 := winner.(proto.Message)
+	if ok1 && ok2 {
+		dst.Reset()
+		proto.Merge(dst, src)
+		return nil
+	}
+	reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(winner).Elem())
+	return nil
+}
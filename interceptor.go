@@ -0,0 +1,86 @@
+package bhgrpcutils
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// interceptors : called in order after the default interceptor
+var (
+	unaryServerInterceptors  []grpc.UnaryServerInterceptor  // unary
+	streamServerInterceptors []grpc.StreamServerInterceptor // stream
+)
+
+// AddUnaryServerInterceptor add unary interceptor, call before NewServer
+func AddUnaryServerInterceptor(interceptors ...grpc.UnaryServerInterceptor) {
+	unaryServerInterceptors = append(unaryServerInterceptors, interceptors...)
+}
+
+// AddStreamServerInterceptor add stream interceptor, call before NewServer
+func AddStreamServerInterceptor(interceptors ...grpc.StreamServerInterceptor) {
+	streamServerInterceptors = append(streamServerInterceptors, interceptors...)
+}
+
+// chainUnaryHandler wrap handler with the unary interceptors
+func chainUnaryHandler(interceptors []grpc.UnaryServerInterceptor, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) grpc.UnaryHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, req interface{}) (interface{}, error) {
+			return interceptor(ctx, req, info, next)
+		}
+	}
+	return handler
+}
+
+// chainStreamHandler wrap handler with the stream interceptors
+func chainStreamHandler(interceptors []grpc.StreamServerInterceptor, info *grpc.StreamServerInfo, handler grpc.StreamHandler) grpc.StreamHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(srv interface{}, ss grpc.ServerStream) error {
+			return interceptor(srv, ss, info, next)
+		}
+	}
+	return handler
+}
+
+// client interceptors : called in order
+var (
+	unaryClientInterceptors  []grpc.UnaryClientInterceptor  // unary
+	streamClientInterceptors []grpc.StreamClientInterceptor // stream
+)
+
+// AddUnaryClientInterceptor add unary client interceptor, call before NewClient
+func AddUnaryClientInterceptor(interceptors ...grpc.UnaryClientInterceptor) {
+	unaryClientInterceptors = append(unaryClientInterceptors, interceptors...)
+}
+
+// AddStreamClientInterceptor add stream client interceptor, call before NewClient
+func AddStreamClientInterceptor(interceptors ...grpc.StreamClientInterceptor) {
+	streamClientInterceptors = append(streamClientInterceptors, interceptors...)
+}
+
+// chainUnaryClientInterceptor chain the unary client interceptors
+func chainUnaryClientInterceptor(interceptors []grpc.UnaryClientInterceptor) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], invoker
+			invoker = func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				return interceptor(ctx, method, req, reply, cc, next, opts...)
+			}
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// chainStreamClientInterceptor chain the stream client interceptors
+func chainStreamClientInterceptor(interceptors []grpc.StreamClientInterceptor) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], streamer
+			streamer = func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+				return interceptor(ctx, desc, cc, method, next, opts...)
+			}
+		}
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+}
@@ -0,0 +1,153 @@
+package bhgrpcutils
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/buhuoxinxi/bh-go-grpc-utils/etcd_balancer"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// method lock config
+const (
+	methodLockKeyPrefix = "method_lock/" // etcd key prefix
+)
+
+// lock key template field : {id} or {order.id}
+var methodLockFieldRegexp = regexp.MustCompile(`\{([\w.]+)\}`)
+
+// MethodLockConfig method lock interceptor config
+type MethodLockConfig struct {
+	KeyTemplates map[string]string // full method => lock key template, e.g. "/order.Order/Update" => "order:{id}"
+	LockKeyTTL   int64             // lock key etcd ttl
+	WaitTimeout  time.Duration     // wait for the lock, try once if 0
+	BusyCode     codes.Code        // lock is busy : codes.Aborted(default) or codes.ResourceExhausted
+}
+
+// NewMethodLockUnaryInterceptor run the method on one instance at a time per lock key
+//
+// the lock key fields are read from the request message, the handler ctx is
+// cancelled when the lock lease is lost.
+func NewMethodLockUnaryInterceptor(cfg *MethodLockConfig) grpc.UnaryServerInterceptor {
+	busyCode := cfg.BusyCode
+	if busyCode == codes.OK {
+		busyCode = codes.Aborted
+	}
+
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		// lock key
+		template, ok := cfg.KeyTemplates[info.FullMethod]
+		if !ok {
+			return handler(ctx, req)
+		}
+		lockKey, err := parseMethodLockKey(template, req)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "method lock key : %v", err)
+		}
+
+		// lock & handle
+		opts := &balancer.LockOptions{
+			LockKeyTTL:  cfg.LockKeyTTL,
+			TryOnce:     cfg.WaitTimeout <= 0,
+			WaitTimeout: cfg.WaitTimeout,
+		}
+		var isLocked bool
+		_, err = balancer.WithLock(ctx, methodLockKeyPrefix+lockKey, opts, func(ctx context.Context) error {
+			isLocked = true
+			var handlerErr error
+			resp, handlerErr = handler(ctx, req)
+			return handlerErr
+		})
+
+		// lock is busy
+		if !isLocked && (err == balancer.ErrLockIsLocking || err == balancer.ErrLockWaitTimeout) {
+			return nil, status.Errorf(busyCode, "method lock is busy : %s", lockKey)
+		}
+		return resp, err
+	}
+}
+
+// parseMethodLockKey replace the template fields with the request fields
+//
+// the field values are path escaped : a "/" in the value does not change the
+// etcd key hierarchy
+func parseMethodLockKey(template string, req interface{}) (string, error) {
+	var err error
+	lockKey := methodLockFieldRegexp.ReplaceAllStringFunc(template, func(field string) string {
+		path := strings.Trim(field, "{}")
+		value, ok := getMessageField(req, path)
+		if !ok || len(value) == 0 {
+			err = fmt.Errorf("empty request field %s", path)
+		}
+		return url.PathEscape(value)
+	})
+	return lockKey, err
+}
+
+// getMessageField read message field by path, e.g. order.id
+func getMessageField(msg interface{}, path string) (string, bool) {
+	v := reflect.ValueOf(msg)
+	for _, name := range strings.Split(path, ".") {
+		// struct
+		for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+			if v.IsNil() {
+				return "", false
+			}
+			v = v.Elem()
+		}
+		if v.Kind() != reflect.Struct {
+			return "", false
+		}
+
+		// field
+		i, ok := getMessageFieldIndex(v.Type(), name)
+		if !ok {
+			return "", false
+		}
+		v = v.Field(i)
+	}
+
+	// value
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return "", false
+		}
+		v = v.Elem()
+	}
+	return fmt.Sprint(v.Interface()), true
+}
+
+// getMessageFieldIndex field index by proto name, json name or go name
+func getMessageFieldIndex(t reflect.Type, name string) (int, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		// proto name : protobuf:"bytes,1,opt,name=order_id,json=orderId,proto3"
+		for _, tag := range strings.Split(f.Tag.Get("protobuf"), ",") {
+			if tag == "name="+name || tag == "json="+name {
+				return i, true
+			}
+		}
+
+		// json name
+		if strings.Split(f.Tag.Get("json"), ",")[0] == name {
+			return i, true
+		}
+
+		// go name
+		if strings.EqualFold(f.Name, strings.Replace(name, "_", "", -1)) {
+			return i, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,341 @@
+package bhgrpcutils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buhuoxinxi/bh-go-grpc-utils/etcd_balancer"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// rate limit config
+const (
+	RateLimitAnyMethod = "*" // default limit of the methods without limit
+
+	defaultRateLimitSweepInterval  = time.Minute     // idle buckets sweep interval
+	defaultRateLimitClusterTimeout = time.Second     // etcd call timeout of the cluster buckets
+	defaultRateLimitClusterHold    = time.Second     // unused tokens taken from etcd are dropped after
+	rateLimitAuthorizationKey      = "authorization" // default principal metadata key
+	rateLimitAnonymousSubject      = "anonymous"     // quota failure subject of the calls without principal
+)
+
+// RateLimit token bucket
+type RateLimit struct {
+	Rate  float64 // tokens per second, 0 : deny all calls
+	Burst int     // bucket size, Rate if 0
+}
+
+// RateLimitConfig rate limit interceptor config
+type RateLimitConfig struct {
+	Methods      map[string]*RateLimit            // full method or RateLimitAnyMethod => limit of the method
+	Principals   map[string]*RateLimit            // full method or RateLimitAnyMethod => limit per principal of the method
+	PrincipalFn  func(ctx context.Context) string // principal of the call, the authorization metadata if nil
+	ClusterWide  bool                             // share the buckets by the instances in etcd, see NewRateLimitUnaryInterceptor
+	ClusterBatch int                              // tokens taken from etcd at once, 1 if 0
+}
+
+// NewRateLimitUnaryInterceptor token bucket rate limit per method and per principal
+//
+// the exceeded call returns codes.ResourceExhausted with the RetryInfo details.
+// the calls without principal share one bucket per method. the buckets idle
+// until full are swept.
+//
+// ClusterWide : the buckets are shared by the instances in etcd, the limits
+// hold for the cluster. an instance takes ClusterBatch tokens per etcd call and
+// drops the unused ones after a second; the calls are allowed while etcd is
+// unavailable.
+func NewRateLimitUnaryInterceptor(cfg *RateLimitConfig) grpc.UnaryServerInterceptor {
+	limiter := newRateLimiter(cfg)
+
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		if err := limiter.allow(ctx, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// NewRateLimitStreamInterceptor token bucket rate limit per method and per principal, one token per stream
+func NewRateLimitStreamInterceptor(cfg *RateLimitConfig) grpc.StreamServerInterceptor {
+	limiter := newRateLimiter(cfg)
+
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := limiter.allow(ss.Context(), info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// rateLimiter token buckets
+type rateLimiter struct {
+	config    *RateLimitConfig
+	cluster   *balancer.ClusterRateLimiter // nil : local buckets
+	bucketMap sync.Map                     // method or method + principal => rateBucket
+	sweepTime int64                        // unix nano of the last idle buckets sweep
+}
+
+// rateBucket local or cluster token bucket
+type rateBucket interface {
+	take(ctx context.Context, now time.Time) (ok bool, retryAfter time.Duration)
+	isIdle(now time.Time) bool
+}
+
+// newRateLimiter rate limiter, the config is copied
+func newRateLimiter(cfg *RateLimitConfig) *rateLimiter {
+	c := *cfg
+	l := &rateLimiter{config: &c, sweepTime: time.Now().UnixNano()}
+	if c.PrincipalFn == nil {
+		c.PrincipalFn = authorizationPrincipal
+	}
+	if c.ClusterWide {
+		if c.ClusterBatch <= 0 {
+			c.ClusterBatch = 1
+		}
+		l.cluster = balancer.NewClusterRateLimiter()
+	}
+	return l
+}
+
+// allow take one token of the method bucket and the principal bucket
+func (l *rateLimiter) allow(ctx context.Context, method string) error {
+	now := time.Now()
+	l.maintain(now)
+
+	// method
+	if limit := rateLimitOf(l.config.Methods, method); limit != nil {
+		if ok, retryAfter := l.take(ctx, now, method, limit); !ok {
+			return rateLimitError(method, "method:"+method, retryAfter)
+		}
+	}
+
+	// principal
+	if limit := rateLimitOf(l.config.Principals, method); limit != nil {
+		// anonymous : the key "method|" is shared by the calls without principal
+		principal := l.config.PrincipalFn(ctx)
+		subject := "principal:" + principal
+		if principal == "" {
+			subject = "principal:" + rateLimitAnonymousSubject
+		}
+		if ok, retryAfter := l.take(ctx, now, method+"|"+principal, limit); !ok {
+			return rateLimitError(method, subject, retryAfter)
+		}
+	}
+	return nil
+}
+
+// take one token of the key bucket, the limit of rate 0 denies all calls
+func (l *rateLimiter) take(ctx context.Context, now time.Time, key string, limit *RateLimit) (ok bool, retryAfter time.Duration) {
+	if limit.Rate <= 0 {
+		return false, 0
+	}
+	return l.bucket(key, limit).take(ctx, now)
+}
+
+// bucket token bucket of the key
+func (l *rateLimiter) bucket(key string, limit *RateLimit) rateBucket {
+	if b, ok := l.bucketMap.Load(key); ok {
+		return b.(rateBucket)
+	}
+	var b rateBucket
+	if l.cluster != nil {
+		b = &clusterBucket{cluster: l.cluster, key: key, limit: limit, batch: l.config.ClusterBatch}
+	} else {
+		b = newTokenBucket(limit)
+	}
+	actual, _ := l.bucketMap.LoadOrStore(key, b)
+	return actual.(rateBucket)
+}
+
+// maintain sweep the idle buckets by the calls, no goroutine outlives the
+// interceptor
+func (l *rateLimiter) maintain(now time.Time) {
+	if isRateLimitDue(&l.sweepTime, now, defaultRateLimitSweepInterval) {
+		go l.sweep(now)
+	}
+}
+
+// isRateLimitDue the interval is passed since the last time, one caller wins
+func isRateLimitDue(lastTime *int64, now time.Time, interval time.Duration) bool {
+	last := atomic.LoadInt64(lastTime)
+	if now.UnixNano()-last < int64(interval) {
+		return false
+	}
+	return atomic.CompareAndSwapInt64(lastTime, last, now.UnixNano())
+}
+
+// sweep delete the buckets refilled to full : a new bucket is the same
+func (l *rateLimiter) sweep(now time.Time) {
+	l.bucketMap.Range(func(key, value interface{}) bool {
+		if value.(rateBucket).isIdle(now) {
+			l.bucketMap.Delete(key)
+		}
+		return true
+	})
+}
+
+// rateLimitOf limit of the method, or the default limit
+func rateLimitOf(limits map[string]*RateLimit, method string) *RateLimit {
+	if limit, ok := limits[method]; ok {
+		return limit
+	}
+	return limits[RateLimitAnyMethod]
+}
+
+// authorizationPrincipal hash of the authorization metadata, the secret is not kept
+func authorizationPrincipal(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	values := md.Get(rateLimitAuthorizationKey)
+	if len(values) == 0 || values[0] == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(values[0]))
+	return hex.EncodeToString(sum[:8])
+}
+
+// rateLimitError ResourceExhausted with the quota failure & retry info details,
+// without retry info if the calls are denied until the config changes
+func rateLimitError(method, subject string, retryAfter time.Duration) error {
+	s := status.New(codes.ResourceExhausted, "rate limit exceeded : "+method)
+	details := []proto.Message{
+		&errdetails.QuotaFailure{Violations: []*errdetails.QuotaFailure_Violation{{
+			Subject:     subject,
+			Description: "rate limit exceeded",
+		}}},
+	}
+	if retryAfter > 0 {
+		details = append(details, &errdetails.RetryInfo{RetryDelay: ptypes.DurationProto(retryAfter)})
+	}
+	ds, err := s.WithDetails(details...)
+	if err != nil {
+		return s.Err()
+	}
+	return ds.Err()
+}
+
+// tokenBucket token bucket
+type tokenBucket struct {
+	limit *RateLimit
+
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket full bucket
+func newTokenBucket(limit *RateLimit) *tokenBucket {
+	return &tokenBucket{
+		limit:  limit,
+		tokens: limit.burst(),
+		last:   time.Now(),
+	}
+}
+
+// take one token, the rate is greater than 0
+func (b *tokenBucket) take(ctx context.Context, now time.Time) (ok bool, retryAfter time.Duration) {
+	rate, burst := b.limit.Rate, b.limit.burst()
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// refill
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed*rate)
+		b.last = now
+	}
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// isIdle the bucket is refilled to full since the last take
+func (b *tokenBucket) isIdle(now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.limit.Rate <= 0 {
+		return false
+	}
+	elapsed := now.Sub(b.last).Seconds()
+	return elapsed > 0 && b.tokens+elapsed*b.limit.Rate >= b.limit.burst()
+}
+
+// burst bucket size
+func (limit *RateLimit) burst() float64 {
+	if limit.Burst > 0 {
+		return float64(limit.Burst)
+	}
+	return math.Max(1, limit.Rate)
+}
+
+// clusterBucket tokens taken from the bucket shared in etcd
+type clusterBucket struct {
+	cluster *balancer.ClusterRateLimiter
+	key     string
+	limit   *RateLimit
+	batch   int
+
+	mutex      sync.Mutex
+	tokens     int       // taken, not used
+	takenTime  time.Time // the tokens are dropped after defaultRateLimitClusterHold
+	retryUntil time.Time // no token in etcd before
+}
+
+// take one token, a batch of tokens is taken from etcd if none is left
+func (b *clusterBucket) take(ctx context.Context, now time.Time) (ok bool, retryAfter time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// local
+	if b.tokens > 0 && now.Sub(b.takenTime) < defaultRateLimitClusterHold {
+		b.tokens--
+		return true, 0
+	}
+	b.tokens = 0
+	if now.Before(b.retryUntil) {
+		return false, b.retryUntil.Sub(now)
+	}
+
+	// etcd
+	etcdCtx, cancelFn := context.WithTimeout(ctx, defaultRateLimitClusterTimeout)
+	defer cancelFn()
+	granted, retryAfter, err := b.cluster.Take(etcdCtx, b.key, b.limit.Rate, b.limit.burst(), b.batch)
+	if err != nil {
+		logrus.Errorf("[E] rate limit ClusterRateLimiter.Take error : %v", err)
+		return true, 0
+	}
+	if granted == 0 {
+		b.retryUntil = now.Add(retryAfter)
+		return false, retryAfter
+	}
+	b.tokens, b.takenTime = granted-1, now
+	return true, 0
+}
+
+// isIdle no token is held and the etcd bucket is not waited for
+func (b *clusterBucket) isIdle(now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return now.Sub(b.takenTime) >= defaultRateLimitClusterHold && !now.Before(b.retryUntil)
+}
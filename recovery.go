@@ -0,0 +1,71 @@
+package bhgrpcutils
+
+import (
+	"expvar"
+	"runtime/debug"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// recovery config
+const (
+	defaultRecoveryMessage = "internal error" // client message of the panic
+)
+
+// panic metric : full method => panics
+var panicsVar = expvar.NewMap("bh_server_panics_total")
+
+// RecoveryConfig panic recovery config of the default interceptors
+type RecoveryConfig struct {
+	Message string                                                                         // client message, "internal error" if empty
+	Hook    func(ctx context.Context, method string, panicValue interface{}, stack []byte) // called after the log, e.g. alert notifier
+	RePanic bool                                                                           // re-panic in development, ignored in production
+}
+
+// recoveryConfig recovery config
+var recoveryConfig = &RecoveryConfig{}
+
+// SetRecoveryConfig set the panic recovery config, call before NewServer
+func SetRecoveryConfig(cfg *RecoveryConfig) {
+	recoveryConfig = cfg
+}
+
+// recoverPanic log the panic with the stack, count it and call the hook;
+// the client gets codes.Internal without the panic value
+func recoverPanic(ctx context.Context, method string, panicValue interface{}) error {
+	stack := debug.Stack()
+	cfg := recoveryConfig
+
+	Logger(ctx).WithFields(logrus.Fields{
+		"method": method,
+		"panic":  panicValue,
+		"stack":  string(stack),
+	}).Error("panic recovered")
+	panicsVar.Add(method, 1)
+
+	if cfg.Hook != nil {
+		callRecoveryHook(ctx, cfg.Hook, method, panicValue, stack)
+	}
+	if cfg.RePanic && !config.IsProduction() {
+		panic(panicValue)
+	}
+
+	message := cfg.Message
+	if message == "" {
+		message = defaultRecoveryMessage
+	}
+	return status.Error(codes.Internal, message)
+}
+
+// callRecoveryHook call the hook, the hook panic is logged
+func callRecoveryHook(ctx context.Context, hook func(context.Context, string, interface{}, []byte), method string, panicValue interface{}, stack []byte) {
+	defer func() {
+		if e := recover(); e != nil {
+			Logger(ctx).WithFields(logrus.Fields{"method": method, "panic": e}).Error("recovery hook panic")
+		}
+	}()
+	hook(ctx, method, panicValue, stack)
+}
@@ -0,0 +1,87 @@
+package bhgrpcutils
+
+import (
+	"github.com/rs/xid"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// request id config
+const (
+	requestIDMetadataKey = "x-request-id" // request id metadata key
+	requestIDLogField    = "request_id"   // logrus field
+)
+
+// requestIDKey ctx key
+type requestIDKey struct{}
+
+// WithRequestID ctx with the request id
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestIDFromContext request id of the ctx, or of the incoming metadata
+func RequestIDFromContext(ctx context.Context) string {
+	if requestID, ok := ctx.Value(requestIDKey{}).(string); ok {
+		return requestID
+	}
+	return incomingRequestID(ctx)
+}
+
+// Logger logrus entry with the request id of the ctx
+func Logger(ctx context.Context) *logrus.Entry {
+	if requestID := RequestIDFromContext(ctx); requestID != "" {
+		return logrus.WithField(requestIDLogField, requestID)
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+// incomingRequestID request id metadata
+func incomingRequestID(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if values := md.Get(requestIDMetadataKey); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// serverRequestID read the x-request-id metadata or generate one, the id is
+// stored in the ctx and sent back in the header
+func serverRequestID(ctx context.Context) (context.Context, string) {
+	requestID := incomingRequestID(ctx)
+	if requestID == "" {
+		requestID = xid.New().String()
+	}
+	return WithRequestID(ctx, requestID), requestID
+}
+
+// NewRequestIDUnaryClientInterceptor forward the request id of the ctx
+func NewRequestIDUnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(outgoingRequestID(ctx), method, req, reply, cc, opts...)
+	}
+}
+
+// NewRequestIDStreamClientInterceptor forward the request id of the ctx
+func NewRequestIDStreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(outgoingRequestID(ctx), desc, cc, method, opts...)
+	}
+}
+
+// outgoingRequestID ctx with the x-request-id metadata, the caller metadata is kept
+func outgoingRequestID(ctx context.Context) context.Context {
+	requestID := RequestIDFromContext(ctx)
+	if requestID == "" {
+		return ctx
+	}
+	if md, ok := metadata.FromOutgoingContext(ctx); ok && len(md.Get(requestIDMetadataKey)) > 0 {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, requestID)
+}
@@ -0,0 +1,212 @@
+package bhgrpcutils
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// retry config
+const (
+	defaultRetryMaxAttempts       = 3                     // attempts, including the first call
+	defaultRetryInitialBackoff    = 50 * time.Millisecond // first backoff
+	defaultRetryMaxBackoff        = 1 * time.Second       // max backoff
+	defaultRetryBackoffMultiplier = 2.0                   // backoff multiplier
+	defaultRetryBudgetRatio       = 0.1                   // retries / requests
+	defaultRetryBudgetMinRetries  = 10                    // retries allowed per window whatever the ratio
+	defaultRetryBudgetWindow      = 10 * time.Second      // budget window
+)
+
+// default retryable codes
+var defaultRetryableCodes = []codes.Code{codes.Unavailable}
+
+// RetryPolicy method retry policy
+type RetryPolicy struct {
+	MaxAttempts       int           // attempts, including the first call
+	InitialBackoff    time.Duration // first backoff
+	MaxBackoff        time.Duration // max backoff
+	BackoffMultiplier float64       // backoff multiplier
+	RetryableCodes    []codes.Code  // retryable status codes
+	EnableStream      bool          // retry stream creation, streams are excluded by default
+}
+
+// RetryConfig client retry config
+type RetryConfig struct {
+	Default          *RetryPolicy            // default policy, nil : no retry
+	Methods          map[string]*RetryPolicy // full method => policy
+	BudgetRatio      float64                 // retries are capped at ratio of the requests
+	BudgetMinRetries int                     // retries allowed per window whatever the ratio
+}
+
+// NewRetryUnaryClientInterceptor retry unary calls with exponential backoff and jitter
+func NewRetryUnaryClientInterceptor(cfg *RetryConfig) grpc.UnaryClientInterceptor {
+	budget := newRetryBudget(cfg.BudgetRatio, cfg.BudgetMinRetries)
+
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		policy := cfg.getPolicy(method)
+		budget.addRequest()
+		if policy == nil {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		for attempt := 1; ; attempt++ {
+			err := invoker(ctx, method, req, reply, cc, opts...)
+			if !policy.shouldRetry(ctx, err, attempt) || !budget.allowRetry() {
+				return err
+			}
+			if waitErr := policy.wait(ctx, attempt); waitErr != nil {
+				return err
+			}
+		}
+	}
+}
+
+// NewRetryStreamClientInterceptor retry stream creation of the methods with EnableStream
+func NewRetryStreamClientInterceptor(cfg *RetryConfig) grpc.StreamClientInterceptor {
+	budget := newRetryBudget(cfg.BudgetRatio, cfg.BudgetMinRetries)
+
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		policy := cfg.getPolicy(method)
+		budget.addRequest()
+		if policy == nil || !policy.EnableStream {
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+
+		for attempt := 1; ; attempt++ {
+			stream, err := streamer(ctx, desc, cc, method, opts...)
+			if !policy.shouldRetry(ctx, err, attempt) || !budget.allowRetry() {
+				return stream, err
+			}
+			if waitErr := policy.wait(ctx, attempt); waitErr != nil {
+				return stream, err
+			}
+		}
+	}
+}
+
+// getPolicy method policy or default
+func (c *RetryConfig) getPolicy(method string) *RetryPolicy {
+	if policy, ok := c.Methods[method]; ok {
+		return policy
+	}
+	return c.Default
+}
+
+// shouldRetry retryable code and attempts left
+func (p *RetryPolicy) shouldRetry(ctx context.Context, err error, attempt int) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+
+	maxAttempts := p.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultRetryMaxAttempts
+	}
+	if attempt >= maxAttempts {
+		return false
+	}
+
+	retryableCodes := p.RetryableCodes
+	if len(retryableCodes) == 0 {
+		retryableCodes = defaultRetryableCodes
+	}
+	code := status.Code(err)
+	for i := range retryableCodes {
+		if retryableCodes[i] == code {
+			return true
+		}
+	}
+	return false
+}
+
+// wait backoff with full jitter : random [0, min(max, initial * multiplier^(attempt-1)))
+func (p *RetryPolicy) wait(ctx context.Context, attempt int) error {
+	var (
+		backoff    = p.InitialBackoff
+		maxBackoff = p.MaxBackoff
+		multiplier = p.BackoffMultiplier
+	)
+	if backoff <= 0 {
+		backoff = defaultRetryInitialBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = defaultRetryMaxBackoff
+	}
+	if multiplier < 1 {
+		multiplier = defaultRetryBackoffMultiplier
+	}
+	for i := 1; i < attempt && backoff < maxBackoff; i++ {
+		backoff = time.Duration(float64(backoff) * multiplier)
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(backoff) + 1)))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// retryBudget retries are capped at ratio of the requests per window
+type retryBudget struct {
+	mutex      sync.Mutex
+	ratio      float64
+	minRetries int
+	windowTime time.Time
+	requests   int
+	retries    int
+}
+
+// newRetryBudget retry budget
+func newRetryBudget(ratio float64, minRetries int) *retryBudget {
+	b := &retryBudget{
+		ratio:      ratio,
+		minRetries: minRetries,
+		windowTime: time.Now(),
+	}
+	if b.ratio <= 0 {
+		b.ratio = defaultRetryBudgetRatio
+	}
+	if b.minRetries <= 0 {
+		b.minRetries = defaultRetryBudgetMinRetries
+	}
+	return b
+}
+
+// resetWindow start a new window
+func (b *retryBudget) resetWindow() {
+	if time.Since(b.windowTime) > defaultRetryBudgetWindow {
+		b.windowTime, b.requests, b.retries = time.Now(), 0, 0
+	}
+}
+
+// addRequest count request
+func (b *retryBudget) addRequest() {
+	b.mutex.Lock()
+	b.resetWindow()
+	b.requests++
+	b.mutex.Unlock()
+}
+
+// allowRetry take a retry from the budget
+func (b *retryBudget) allowRetry() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.resetWindow()
+	if b.retries >= b.minRetries && float64(b.retries) >= b.ratio*float64(b.requests) {
+		return false
+	}
+	b.retries++
+	return true
+}
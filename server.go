@@ -6,14 +6,11 @@ import (
 	"github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
-	"google.golang.org/grpc/status"
 	"net"
 	"os"
 	"os/signal"
-	"runtime/debug"
 	"syscall"
 )
 
@@ -63,8 +60,20 @@ func RunServer(server *grpc.Server) {
 	logrus.Printf("server addr : %s", serverAddr)
 
 	// register server to etcd
-	if err := balancer.RegisterServer(serverAddr); err != nil {
-		logrus.Panicf("balancer.RegisterServer error : %v", err)
+	var unRegisterFn func()
+	if config.LeaderOnly {
+		// leader only
+		election, err := balancer.RegisterLeaderServer(serverAddr)
+		if err != nil {
+			logrus.Panicf("balancer.RegisterLeaderServer error : %v", err)
+		}
+		unRegisterFn = election.Stop
+	} else {
+		registrar, err := balancer.StartRegistrar(serverAddr)
+		if err != nil {
+			logrus.Panicf("balancer.StartRegistrar error : %v", err)
+		}
+		unRegisterFn = registrar.Stop
 	}
 
 	// remove server from etcd
@@ -73,7 +82,8 @@ func RunServer(server *grpc.Server) {
 	go func() {
 		s := <-ch
 
-		balancer.UnRegisterServer(serverAddr)
+		// revoke lease
+		unRegisterFn()
 
 		if i, ok := s.(syscall.Signal); ok {
 			os.Exit(int(i))
@@ -104,6 +114,9 @@ var DefaultGRPCAuthorizationFn = func(ctx context.Context) error {
 // DefaultUnaryInterceptorFn unary interceptor
 var DefaultUnaryInterceptorFn = func() grpc.ServerOption {
 	interceptor := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		// request id
+		ctx, requestID := serverRequestID(ctx)
+		grpc.SetHeader(ctx, metadata.Pairs(requestIDMetadataKey, requestID))
 
 		// request log
 		go DefaultUnaryRequestLog(ctx, info.FullMethod, req)
@@ -116,13 +129,12 @@ var DefaultUnaryInterceptorFn = func() grpc.ServerOption {
 		// recover
 		defer func() {
 			if e := recover(); e != nil {
-				debug.PrintStack()
-				err = status.Errorf(codes.Internal, "Panic err: %v", e)
+				err = recoverPanic(ctx, info.FullMethod, e)
 			}
 		}()
 
 		// next
-		return handler(ctx, req)
+		return chainUnaryHandler(unaryServerInterceptors, info, handler)(ctx, req)
 	}
 	return grpc.UnaryInterceptor(interceptor)
 }
@@ -141,6 +153,10 @@ var DefaultUnaryRequestLog = func(ctx context.Context, method string, reqParam i
 // DefaultStreamInterceptorFn stream interceptor
 var DefaultStreamInterceptorFn = func() grpc.ServerOption {
 	var interceptor = func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		// request id
+		ctx, requestID := serverRequestID(ss.Context())
+		ss.SetHeader(metadata.Pairs(requestIDMetadataKey, requestID))
+		ss = &contextServerStream{ServerStream: ss, ctx: ctx}
 
 		// request log
 		go DefaultStreamRequestLog(srv, ss, info)
@@ -153,13 +169,12 @@ var DefaultStreamInterceptorFn = func() grpc.ServerOption {
 		// recover
 		defer func() {
 			if e := recover(); e != nil {
-				debug.PrintStack()
-				err = status.Errorf(codes.Internal, "Panic err: %v", e)
+				err = recoverPanic(ss.Context(), info.FullMethod, e)
 			}
 		}()
 
 		// next
-		return handler(srv, ss)
+		return chainStreamHandler(streamServerInterceptors, info, handler)(srv, ss)
 	}
 	return grpc.StreamInterceptor(interceptor)
 }
@@ -10,6 +10,11 @@ func init() {
 	// host
 	os.Setenv("BhServerHost", "")
 	os.Setenv("BhServerPort", "50051")
+	os.Setenv("BhServerLeaderOnly", "false")
+	os.Setenv("BhServerEnvironment", "development")
+
+	// client
+	os.Setenv("BhClientDefaultTimeout", "10s")
 
 	// resolver
 	os.Setenv("BhServerResolverSchema", "bh_ikaigunag")
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/coreos/etcd/embed"
+	"github.com/sirupsen/logrus"
+)
+
+// embed etcd for the testdata executables
+//
+// go run ./testdata/executable/etcd.go
+func main() {
+	// data dir
+	dir, err := ioutil.TempDir("", "bh_embed_etcd")
+	if err != nil {
+		logrus.Panicf("ioutil.TempDir error : %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// config : listen client 127.0.0.1:2379
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+
+	// start
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		logrus.Panicf("embed.StartEtcd error : %v", err)
+	}
+	defer e.Close()
+
+	select {
+	case <-e.Server.ReadyNotify():
+		logrus.Printf("embed etcd is ready : %s", cfg.LCUrls[0].String())
+	case <-time.After(time.Minute):
+		e.Server.Stop()
+		logrus.Panic("embed etcd start timeout")
+	}
+
+	// block
+	logrus.Error(<-e.Err())
+}